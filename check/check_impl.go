@@ -17,9 +17,11 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"math"
 	"net/http"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 
 	"code.google.com/p/go.tools/go/exact"
@@ -139,6 +141,16 @@ func (c *checker) InsertMetricValuesFromJSON() error {
 	}
 	defer resp.Body.Close()
 	d := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		//failed responses hold {"Error": "...", "Failed": [...]}
+		var failed struct {
+			Error string
+		}
+		if d.Decode(&failed) == nil && failed.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, failed.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
 	var metrics []metrics.MetricJSON
 	err = d.Decode(&metrics)
 	if err != nil {
@@ -149,21 +161,20 @@ func (c *checker) InsertMetricValuesFromJSON() error {
 	for _, m := range metrics {
 		switch val := m.Value.(type) {
 		case float64:
-			name := strings.Replace(m.Name, ".", "_", -1) + "_value"
+			name := constName(m.Name, m.Labels) + "_value"
 			c.sc.Insert(types.NewConst(0, c.pkg, name,
 				types.New("float64"), exact.MakeFloat64(val)))
 		case map[string]interface{}:
 			//TODO: make sure we don't panic in case something is not formatted
 			// like expected
-			if current, ok := val["current"]; ok {
-				name := strings.Replace(m.Name, ".", "_", -1) + "_current"
-				c.sc.Insert(types.NewConst(0, c.pkg, name,
-					types.New("float64"), exact.MakeFloat64(current.(float64))))
-			}
-			if rate, ok := val["rate"]; ok {
-				name := strings.Replace(m.Name, ".", "_", -1) + "_rate"
+			for _, key := range []string{"current", "rate", "rate1", "rate5", "rate15", "resets"} {
+				v, ok := val[key].(float64)
+				if !ok {
+					continue
+				}
+				name := constName(m.Name, m.Labels) + "_" + key
 				c.sc.Insert(types.NewConst(0, c.pkg, name,
-					types.New("float64"), exact.MakeFloat64(rate.(float64))))
+					types.New("float64"), exact.MakeFloat64(v)))
 			}
 		default:
 			//a value type came up that wasn't anticipated
@@ -174,24 +185,82 @@ func (c *checker) InsertMetricValuesFromJSON() error {
 }
 
 func (c *checker) InsertMetricValuesFromContext(m *metrics.MetricContext) error {
-	for metricName, metric := range m.Gauges {
-		name := strings.Replace(metricName, ".", "_", -1) + "_value"
-		c.sc.Insert(types.NewConst(0, c.pkg, name,
-			types.New("float64"), exact.MakeFloat64(metric.Get())))
-		sname := name + "_string"
-		c.sc.Insert(types.NewConst(0, c.pkg, sname,
-			types.New("string"), exact.MakeString(fmt.Sprintf("%0.2f", metric.Get()))))
-	}
-	for metricName, metric := range m.Counters {
-		name := strings.Replace(metricName, ".", "_", -1) + "_current"
-		c.sc.Insert(types.NewConst(0, c.pkg, name,
-			types.New("float64"), exact.MakeUint64(metric.Get())))
-		sname := name + "_string"
-		c.sc.Insert(types.NewConst(0, c.pkg, sname,
-			types.New("string"), exact.MakeString(fmt.Sprintf("%d", metric.Get()))))
-		name = strings.Replace(metricName, ".", "_", -1) + "_rate"
-		c.sc.Insert(types.NewConst(0, c.pkg, name,
-			types.New("float64"), exact.MakeFloat64(metric.ComputeRate())))
+	for metricName, metric := range m.Metrics() {
+		c.insertMetric(constName(metricName, nil), metric)
+	}
+	for _, l := range append(m.LabeledMetrics(), m.Collect()...) {
+		c.insertMetric(constName(l.Name, l.Labels), l.Metric)
 	}
 	return nil
 }
+
+//insertMetric inserts gauges and counters with their string forms, and
+// every other metric as one constant per value, see metrics.Metric
+func (c *checker) insertMetric(prefix string, metric metrics.Metric) {
+	switch metric := metric.(type) {
+	case *metrics.Gauge:
+		c.insertGauge(prefix, metric)
+	case *metrics.Counter:
+		c.insertCounter(prefix, metric)
+	default:
+		for key, v := range metric.Values() {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			c.sc.Insert(types.NewConst(0, c.pkg, prefix+"_"+constName(key, nil),
+				types.New("float64"), exact.MakeFloat64(v)))
+		}
+	}
+}
+
+func (c *checker) insertGauge(prefix string, metric *metrics.Gauge) {
+	name := prefix + "_value"
+	c.sc.Insert(types.NewConst(0, c.pkg, name,
+		types.New("float64"), exact.MakeFloat64(metric.Get())))
+	sname := name + "_string"
+	c.sc.Insert(types.NewConst(0, c.pkg, sname,
+		types.New("string"), exact.MakeString(fmt.Sprintf("%0.2f", metric.Get()))))
+}
+
+func (c *checker) insertCounter(prefix string, metric *metrics.Counter) {
+	name := prefix + "_current"
+	c.sc.Insert(types.NewConst(0, c.pkg, name,
+		types.New("float64"), exact.MakeUint64(metric.Get())))
+	sname := name + "_string"
+	c.sc.Insert(types.NewConst(0, c.pkg, sname,
+		types.New("string"), exact.MakeString(fmt.Sprintf("%d", metric.Get()))))
+	rates := map[string]float64{
+		"_rate":   metric.WindowRate(),
+		"_rate1":  metric.Rate1(),
+		"_rate5":  metric.Rate5(),
+		"_rate15": metric.Rate15(),
+	}
+	for suffix, rate := range rates {
+		c.sc.Insert(types.NewConst(0, c.pkg, prefix+suffix,
+			types.New("float64"), exact.MakeFloat64(rate)))
+	}
+	c.sc.Insert(types.NewConst(0, c.pkg, prefix+"_resets",
+		types.New("float64"), exact.MakeUint64(metric.Resets())))
+}
+
+//constName returns the prefix of the constants a metric is inserted as.
+// Label values of vector children are appended in label name order, with
+// every character that is not valid in an identifier replaced by '_'
+func constName(metricName string, labels map[string]string) string {
+	name := strings.Replace(metricName, ".", "_", -1)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name += "_" + strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+				return r
+			}
+			return '_'
+		}, labels[k])
+	}
+	return name
+}
@@ -2,6 +2,8 @@ package check
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/measure/metrics"
@@ -102,6 +104,22 @@ func TestInsertMetricValuesFromJSON(t *testing.T) {
 	}
 }
 
+func TestInsertMetricValuesFromJSONError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"Error": "metrics: 1 metric failed to encode"}`))
+	}))
+	defer server.Close()
+	c := initTestChecker()
+	c.hostport = strings.TrimPrefix(server.URL, "http://")
+	c.NewScopeAndPackage()
+	err := c.InsertMetricValuesFromJSON()
+	want := "500 Internal Server Error: metrics: 1 metric failed to encode"
+	if err == nil || err.Error() != want {
+		t.Errorf("InsertMetricValuesFromJSON() = %v, want %v", err, want)
+	}
+}
+
 func TestInsertMetricValuesFromContext(t *testing.T) {
 	c := initTestChecker()
 	c.NewScopeAndPackage()
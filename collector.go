@@ -0,0 +1,154 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Collector produces a batch of metrics at scrape time, e.g. one gauge
+// per table from a single query. Collect adds the metrics to b and
+// returns an error if it could not produce all of them; the metrics
+// added so far are still exported
+type Collector interface {
+	Collect(b *Batch) error
+}
+
+// CollectorFunc adapts a function to a Collector
+type CollectorFunc func(b *Batch) error
+
+// Collect calls f(b)
+func (f CollectorFunc) Collect(b *Batch) error {
+	return f(b)
+}
+
+// Batch receives the metrics of one Collect call. Names are relative to
+// the name the collector is registered under
+type Batch struct {
+	prefix  string
+	metrics []LabeledMetric
+}
+
+// Gauge adds a gauge with value v and the given label name/value pairs
+func (b *Batch) Gauge(name string, v float64, labelsAndValues ...string) {
+	g := NewGauge()
+	g.Set(v)
+	b.Add(name, batchLabels(labelsAndValues), g)
+}
+
+// Counter adds a counter with value v and the given label name/value
+// pairs. It is exported as a BasicCounter
+func (b *Batch) Counter(name string, v uint64, labelsAndValues ...string) {
+	c := NewBasicCounter()
+	c.Set(v)
+	b.Add(name, batchLabels(labelsAndValues), c)
+}
+
+// Add adds metric v with labels, which may be nil
+func (b *Batch) Add(name string, labels map[string]string, v Metric) {
+	b.metrics = append(b.metrics, LabeledMetric{b.prefix + "." + name, labels, v})
+}
+
+// RegisterCollector registers c with metric context. Its metrics are
+// named name.<metric name>, and every collection adds:
+//
+//	name.collect_duration - time Collect took, in seconds
+//	name.collect_error    - 1 if Collect failed, else 0. The JSON
+//	                        output holds the error in its Error field
+//
+// A collector registered under name before is replaced
+func (m *MetricContext) RegisterCollector(c Collector, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.collectors[name] = c
+}
+
+// UnregisterCollector removes the collector registered under name
+func (m *MetricContext) UnregisterCollector(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.collectors, name)
+}
+
+// Collect runs all registered collectors and returns their metrics,
+// sorted by name and then by label values. Encoders call it once per
+// encode pass, alongside Metrics and LabeledMetrics
+func (m *MetricContext) Collect() []LabeledMetric {
+	m.mu.RLock()
+	collectors := make(map[string]Collector, len(m.collectors))
+	for name, c := range m.collectors {
+		collectors[name] = c
+	}
+	m.mu.RUnlock()
+
+	var r []LabeledMetric
+	for name, c := range collectors {
+		b := &Batch{prefix: name}
+		start := time.Now()
+		err := collect(c, b)
+		duration := NewGauge()
+		duration.Set(time.Since(start).Seconds())
+		b.Add("collect_duration", nil, duration)
+		b.Add("collect_error", nil, &collectError{err})
+		r = append(r, b.metrics...)
+	}
+	sort.Sort(labeledMetrics(r))
+	return r
+}
+
+// unexported functions
+
+// collect calls c.Collect, turning a panic into an error
+func collect(c Collector, b *Batch) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("metrics: collector panicked: %v", r)
+		}
+	}()
+	return c.Collect(b)
+}
+
+func batchLabels(labelsAndValues []string) map[string]string {
+	if len(labelsAndValues)%2 != 0 {
+		panic(fmt.Sprintf("metrics: odd number of label arguments %v", labelsAndValues))
+	}
+	if len(labelsAndValues) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(labelsAndValues)/2)
+	for i := 0; i < len(labelsAndValues); i += 2 {
+		labels[labelsAndValues[i]] = labelsAndValues[i+1]
+	}
+	return labels
+}
+
+// errorReporter is implemented by metrics whose JSON form carries an
+// error next to the value, see MetricJSON
+type errorReporter interface {
+	Err() error
+}
+
+// collectError reports the outcome of a Collect call
+type collectError struct {
+	err error
+}
+
+func (e *collectError) Err() error { return e.err }
+
+func (e *collectError) Kind() string { return "gauge" }
+
+func (e *collectError) Values() map[string]float64 {
+	if e.err != nil {
+		return map[string]float64{"value": 1}
+	}
+	return map[string]float64{"value": 0}
+}
+
+func (e *collectError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Values()["value"])
+}
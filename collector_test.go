@@ -0,0 +1,87 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	m := NewMetricContext("test")
+	m.MustNewGauge("uptime").Set(1)
+	m.RegisterCollector(CollectorFunc(func(b *Batch) error {
+		b.Gauge("rows", 10, "table", "users")
+		b.Gauge("rows", 20, "table", "orders")
+		b.Counter("queries", 3)
+		return errors.New("table status incomplete")
+	}), "mysql")
+
+	var buf bytes.Buffer
+	if err := m.EncodeJSONWithOptions(&buf, JSONOptions{Sorted: true}); err != nil {
+		t.Fatal(err)
+	}
+	var out []struct {
+		Name   string
+		Labels map[string]string
+		Value  json.RawMessage
+		Error  string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, o := range out {
+		got[o.Name+labelString(o.Labels)] = string(o.Value)
+		if o.Name == "mysql.collect_error" && o.Error != "table status incomplete" {
+			t.Errorf("mysql.collect_error Error = %q, want %q", o.Error, "table status incomplete")
+		}
+	}
+	want := map[string]string{
+		"uptime":                 "1",
+		"mysql.queries":          "3",
+		"mysql.rowstable=orders": "20",
+		"mysql.rowstable=users":  "10",
+		"mysql.collect_error":    "1",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %s, want %s", k, got[k], v)
+		}
+	}
+	if _, ok := got["mysql.collect_duration"]; !ok {
+		t.Errorf("mysql.collect_duration missing from %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := m.EncodePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "# TYPE test_mysql_rows gauge\n"+
+		"test_mysql_rows{table=\"orders\"} 20\ntest_mysql_rows{table=\"users\"} 10\n") {
+		t.Errorf("EncodePrometheus = %s, want test_mysql_rows per table", buf.String())
+	}
+	if !strings.Contains(buf.String(), "test_mysql_collect_error 1\n") {
+		t.Errorf("EncodePrometheus = %s, want test_mysql_collect_error 1", buf.String())
+	}
+}
+
+func TestCollectorPanic(t *testing.T) {
+	m := NewMetricContext("test")
+	m.RegisterCollector(CollectorFunc(func(b *Batch) error {
+		panic("boom")
+	}), "broken")
+	for _, l := range m.Collect() {
+		if l.Name != "broken.collect_error" {
+			continue
+		}
+		if v := l.Metric.Values()["value"]; v != 1 {
+			t.Errorf("broken.collect_error = %v, want %v", v, 1)
+		}
+		return
+	}
+	t.Errorf("broken.collect_error missing")
+}
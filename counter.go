@@ -4,10 +4,19 @@ package metrics
 
 import (
 	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// interval at which the moving average rates of a Counter are updated
+const RATE_INTERVAL = 5 * time.Second
+
+// window over which Counter.WindowRate is computed; a multiple of
+// RATE_INTERVAL
+const RATE_WINDOW = 10 * time.Second
+
 // Counters
 type Counter struct {
 	v       uint64
@@ -16,6 +25,52 @@ type Counter struct {
 	ticks_p int64
 	ticks_v int64
 	mu      sync.RWMutex
+
+	// reader independent rates, see tick
+	updated bool     // false until the first Set or Add
+	epoch   int64    // TICKS / RATE_INTERVAL of the open interval
+	pending uint64   // increments in the open interval
+	window  []uint64 // increments in the last closed intervals
+	m1      ewma
+	m5      ewma
+	m15     ewma
+	now     func() int64 // clock hook, TICKS if nil
+
+	// reset and wraparound detection, see Set
+	max       uint64 // value after which the source wraps to 0, if set
+	carry     uint64 // wrapped amount not yet seen by ComputeRate
+	resets    uint64
+	lastReset time.Time
+}
+
+// ewma is an exponentially weighted moving average of a per second
+// rate, updated once every RATE_INTERVAL
+type ewma struct {
+	alpha float64
+	rate  float64
+	init  bool
+}
+
+func newEWMA(period time.Duration) ewma {
+	return ewma{alpha: 1 - math.Exp(-float64(RATE_INTERVAL)/float64(period))}
+}
+
+// tick folds the count of one interval into the average
+func (e *ewma) tick(count uint64) {
+	instant := float64(count) / RATE_INTERVAL.Seconds()
+	if e.init {
+		e.rate += e.alpha * (instant - e.rate)
+	} else {
+		e.rate = instant
+		e.init = true
+	}
+}
+
+// decay applies n intervals without any increment
+func (e *ewma) decay(n int64) {
+	if e.init {
+		e.rate *= math.Pow(1-e.alpha, float64(n))
+	}
 }
 
 // Counters differ from BasicCounter by having additional
@@ -39,15 +94,54 @@ func (c *Counter) Reset() {
 	c.ticks_v = 0
 	c.v = 0
 	c.p = 0
+
+	c.updated = false
+	c.initRates(c.clock())
+
+	c.carry = 0
+	c.resets = 0
+	c.lastReset = time.Time{}
+}
+
+// SetMaxValue declares that the mirrored counter wraps around to 0
+// after max, e.g. 1<<32 - 1 for a 32 bit counter. A decreasing value
+// passed to Set is then counted as a wraparound instead of a restart of
+// the source. A max of 0, the default, disables wraparound
+func (c *Counter) SetMaxValue(max uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.max = max
 }
 
 // Set Counter value. This is useful if you are reading a metric
 // that is already a counter
+// A value lower than the current one is a reset: the source restarted
+// and v becomes the new baseline for rates, or, with SetMaxValue, the
+// source wrapped around and the increment across max is counted
 func (c *Counter) Set(v uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.ticks_v = TICKS
+	c.ticks_v = c.clock()
+	c.tick(c.ticks_v)
+	if c.updated && v >= c.v {
+		c.pending += v - c.v
+	} else if c.updated {
+		c.resets++
+		c.lastReset = time.Now()
+		if c.max > 0 && c.v <= c.max {
+			c.pending += c.max - c.v + 1 + v
+			c.carry += c.max + 1
+		} else {
+			// new baseline
+			c.p = v
+			c.ticks_p = c.ticks_v
+			c.rate = 0
+			c.carry = 0
+		}
+	}
+	c.updated = true
 	atomic.StoreUint64(&c.v, v)
 
 	// baseline for rate calculation
@@ -62,7 +156,10 @@ func (c *Counter) Add(delta uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.ticks_v = TICKS
+	c.ticks_v = c.clock()
+	c.tick(c.ticks_v)
+	c.pending += delta
+	c.updated = true
 	atomic.AddUint64(&c.v, delta)
 
 	// baseline for rate calculation
@@ -84,6 +181,9 @@ func (c *Counter) Get() uint64 {
 // second. (acquires a lock)
 // Since we avoid locking on Set/Add operations, rate can be
 // inaccurate on highly contended threads
+// The rate is computed since the previous call, so concurrent readers
+// see each other's deltas. Use WindowRate or the moving averages when
+// the counter has more than one reader
 
 func (c *Counter) ComputeRate() float64 {
 	c.mu.Lock()
@@ -92,14 +192,15 @@ func (c *Counter) ComputeRate() float64 {
 	rate := 0.0
 
 	delta_t := c.ticks_v - c.ticks_p
-	delta_v := c.v - c.p
+	delta_v := c.v + c.carry - c.p
 
 	// we have two samples, compute rate and
 	// cache it away
-	if delta_t > 0 && c.v >= c.p {
+	if delta_t > 0 && c.v+c.carry >= c.p {
 		rate = (float64(delta_v) / float64(delta_t)) * NS_IN_SEC
 		// update baseline
 		c.p = c.v
+		c.carry = 0
 		c.ticks_p = c.ticks_v
 		// cache rate calculated
 		c.rate = rate
@@ -108,10 +209,144 @@ func (c *Counter) ComputeRate() float64 {
 	return c.rate
 }
 
+// WindowRate returns the rate of change per second over the last
+// RATE_WINDOW, excluding the interval in progress
+func (c *Counter) WindowRate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(c.clock())
+	var sum uint64
+	for _, n := range c.window {
+		sum += n
+	}
+	return float64(sum) / RATE_WINDOW.Seconds()
+}
+
+// Rate1 returns the one-minute exponentially weighted moving average
+// of the rate of change per second
+func (c *Counter) Rate1() float64 {
+	return c.movingRate(&c.m1)
+}
+
+// Rate5 returns the five-minute exponentially weighted moving average
+// of the rate of change per second
+func (c *Counter) Rate5() float64 {
+	return c.movingRate(&c.m5)
+}
+
+// Rate15 returns the fifteen-minute exponentially weighted moving
+// average of the rate of change per second
+func (c *Counter) Rate15() float64 {
+	return c.movingRate(&c.m15)
+}
+
+// Resets returns the number of resets and wraparounds detected by Set
+func (c *Counter) Resets() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.resets
+}
+
+// LastReset returns the time of the last reset or wraparound detected
+// by Set, or the zero time if there was none
+func (c *Counter) LastReset() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastReset
+}
+
 // MarshalJSON returns a byte slice of JSON representation of
-// counter
+// counter. rate is WindowRate; reading it does not affect other readers.
+// resets is the number of resets and last_reset the unix time of the
+// last one, or 0
 func (c *Counter) MarshalJSON() ([]byte, error) {
-	rate := c.ComputeRate()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(c.clock())
+	var sum uint64
+	for _, n := range c.window {
+		sum += n
+	}
+	var lastReset int64
+	if !c.lastReset.IsZero() {
+		lastReset = c.lastReset.Unix()
+	}
 	return ([]byte(
-		fmt.Sprintf(`{"current": %d, "rate": %f}`, c.Get(), rate))), nil
+		fmt.Sprintf(`{"current": %d, "rate": %f, "rate1": %f, "rate5": %f, "rate15": %f, "resets": %d, "last_reset": %d}`,
+			c.v, float64(sum)/RATE_WINDOW.Seconds(), c.m1.rate, c.m5.rate, c.m15.rate,
+			c.resets, lastReset))), nil
+}
+
+// unexported functions
+
+// clock returns the current time on the TICKS clock
+func (c *Counter) clock() int64 {
+	if c.now == nil {
+		return atomic.LoadInt64(&TICKS)
+	}
+	return c.now()
+}
+
+// initRates starts the window and the moving averages empty, with the
+// interval holding now open
+func (c *Counter) initRates(now int64) {
+	c.epoch = now / int64(RATE_INTERVAL)
+	c.pending = 0
+	c.window = make([]uint64, RATE_WINDOW/RATE_INTERVAL)
+	c.m1 = newEWMA(time.Minute)
+	c.m5 = newEWMA(5 * time.Minute)
+	c.m15 = newEWMA(15 * time.Minute)
+}
+
+func (c *Counter) movingRate(e *ewma) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick(c.clock())
+	return e.rate
+}
+
+// tick closes every RATE_INTERVAL that ended before now, folding its
+// increments into the moving averages and the window. Intervals are
+// aligned on the TICKS clock and closed lazily by whichever update or
+// read comes first, so the rates do not depend on who reads them or
+// how often. Callers must hold c.mu
+func (c *Counter) tick(now int64) {
+	if c.window == nil {
+		// zero value Counter, not set up by Reset
+		c.initRates(now)
+		return
+	}
+	epoch := now / int64(RATE_INTERVAL)
+	elapsed := epoch - c.epoch
+	if elapsed <= 0 {
+		return
+	}
+	c.epoch = epoch
+
+	// the open interval
+	c.m1.tick(c.pending)
+	c.m5.tick(c.pending)
+	c.m15.tick(c.pending)
+	copy(c.window, c.window[1:])
+	c.window[len(c.window)-1] = c.pending
+	c.pending = 0
+
+	// idle intervals since
+	if idle := elapsed - 1; idle > 0 {
+		c.m1.decay(idle)
+		c.m5.decay(idle)
+		c.m15.decay(idle)
+		if idle >= int64(len(c.window)) {
+			idle = int64(len(c.window))
+		}
+		copy(c.window, c.window[idle:])
+		for i := len(c.window) - int(idle); i < len(c.window); i++ {
+			c.window[i] = 0
+		}
+	}
 }
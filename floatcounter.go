@@ -0,0 +1,62 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"sync/atomic"
+)
+
+// FloatCounter is a counter(float64) accumulating fractional quantities
+// such as CPU seconds - all operations are atomic
+// Usage:
+//   f := metrics.NewFloatCounter()
+//   f.Add(0.25)
+//   f.Get()
+
+func NewFloatCounter() *FloatCounter {
+	c := new(FloatCounter)
+	c.Reset()
+	return c
+}
+
+type FloatCounter struct {
+	bits uint64 // float64 bits
+}
+
+// Reset counter to zero
+func (c *FloatCounter) Reset() {
+	atomic.StoreUint64(&c.bits, math.Float64bits(0))
+}
+
+// Set counter to value v
+func (c *FloatCounter) Set(v float64) {
+	atomic.StoreUint64(&c.bits, math.Float64bits(v))
+}
+
+// Add delta to counter value. A counter never goes down: negative and
+// NaN deltas are ignored
+func (c *FloatCounter) Add(delta float64) {
+	if !(delta >= 0) {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		v := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&c.bits, old, v) {
+			return
+		}
+	}
+}
+
+// Get value of counter
+func (c *FloatCounter) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// MarshalJSON returns a byte slice of JSON representation of
+// floatcounter
+func (c *FloatCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Get())
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// default time a GaugeFunc or CounterFunc callback may take
+const FUNC_TIMEOUT = time.Second
+
+/* GaugeFunc and CounterFunc
+
+GaugeFunc and CounterFunc export a value that lives elsewhere by calling
+a callback whenever the metric is read, e.g. by EncodeJSON or check,
+instead of copying it into a Gauge periodically.
+
+A callback that panics or takes longer than the timeout is reported as
+an error: Get returns it, MarshalJSON writes {"error": "..."} in place
+of the value, and Values returns NaN, which the text encoders leave out.
+Concurrent reads share a single call of the callback. Once a call has
+timed out, reads fail right away until it returns instead of piling up
+goroutines.
+
+Example use:
+  m := metrics.NewMetricContext("webapp")
+  m.Register(metrics.NewGaugeFunc(func() float64 {
+	  return float64(runtime.NumGoroutine())
+  }), "goroutines")
+
+*/
+
+type GaugeFunc struct {
+	f func() float64
+	funcCaller
+}
+
+// NewGaugeFunc initializes a GaugeFunc calling f with a timeout of
+// FUNC_TIMEOUT
+func NewGaugeFunc(f func() float64) *GaugeFunc {
+	g := &GaugeFunc{f: f}
+	g.SetTimeout(FUNC_TIMEOUT)
+	return g
+}
+
+// Get calls the callback and returns its result
+func (g *GaugeFunc) Get() (float64, error) {
+	v, err := g.call(func() interface{} { return g.f() })
+	if err != nil {
+		return math.NaN(), err
+	}
+	return v.(float64), nil
+}
+
+// Kind returns "gaugefunc"
+func (g *GaugeFunc) Kind() string { return "gaugefunc" }
+
+// Values returns value, NaN if the callback failed
+func (g *GaugeFunc) Values() map[string]float64 {
+	v, _ := g.Get()
+	return map[string]float64{"value": v}
+}
+
+// MarshalJSON returns a byte slice of JSON representation of
+// gaugefunc. Like for a Gauge, NaN and infinite values fail to marshal
+func (g *GaugeFunc) MarshalJSON() ([]byte, error) {
+	v, err := g.Get()
+	if err != nil {
+		return errorMarkerJSON(err)
+	}
+	return json.Marshal(v)
+}
+
+type CounterFunc struct {
+	f func() uint64
+	funcCaller
+}
+
+// NewCounterFunc initializes a CounterFunc calling f with a timeout of
+// FUNC_TIMEOUT. f must return a monotonically increasing value
+func NewCounterFunc(f func() uint64) *CounterFunc {
+	c := &CounterFunc{f: f}
+	c.SetTimeout(FUNC_TIMEOUT)
+	return c
+}
+
+// Get calls the callback and returns its result
+func (c *CounterFunc) Get() (uint64, error) {
+	v, err := c.call(func() interface{} { return c.f() })
+	if err != nil {
+		return 0, err
+	}
+	return v.(uint64), nil
+}
+
+// Kind returns "counterfunc"
+func (c *CounterFunc) Kind() string { return "counterfunc" }
+
+// Values returns value, NaN if the callback failed
+func (c *CounterFunc) Values() map[string]float64 {
+	v, err := c.Get()
+	if err != nil {
+		return map[string]float64{"value": math.NaN()}
+	}
+	return map[string]float64{"value": float64(v)}
+}
+
+// MarshalJSON returns a byte slice of JSON representation of
+// counterfunc
+func (c *CounterFunc) MarshalJSON() ([]byte, error) {
+	v, err := c.Get()
+	if err != nil {
+		return errorMarkerJSON(err)
+	}
+	return json.Marshal(v)
+}
+
+// unexported functions
+
+// funcCaller calls callbacks with a timeout, recovering from panics
+type funcCaller struct {
+	timeout  int64 // time.Duration
+	mu       sync.Mutex
+	inflight *funcCall // call in progress, shared by concurrent callers
+}
+
+// funcCall is a single run of a callback. v and err are set before
+// done is closed
+type funcCall struct {
+	done     chan struct{}
+	v        interface{}
+	err      error
+	timedOut bool // guarded by funcCaller.mu
+}
+
+// SetTimeout sets the time the callback may take
+func (c *funcCaller) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.timeout, int64(timeout))
+}
+
+// call runs f, or waits for the run already in progress
+func (c *funcCaller) call(f func() interface{}) (interface{}, error) {
+	c.mu.Lock()
+	fc := c.inflight
+	if fc != nil && fc.timedOut {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("metrics: callback still running")
+	}
+	if fc == nil {
+		fc = &funcCall{done: make(chan struct{})}
+		c.inflight = fc
+		go c.run(fc, f)
+	}
+	c.mu.Unlock()
+
+	timeout := time.Duration(atomic.LoadInt64(&c.timeout))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-fc.done:
+		return fc.v, fc.err
+	case <-timer.C:
+		c.mu.Lock()
+		fc.timedOut = true
+		c.mu.Unlock()
+		return nil, fmt.Errorf("metrics: callback timed out after %v", timeout)
+	}
+}
+
+func (c *funcCaller) run(fc *funcCall, f func() interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			fc.err = fmt.Errorf("metrics: callback panicked: %v", r)
+		}
+		c.mu.Lock()
+		c.inflight = nil
+		c.mu.Unlock()
+		close(fc.done)
+	}()
+	fc.v = f()
+}
+
+func errorMarkerJSON(err error) ([]byte, error) {
+	return json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
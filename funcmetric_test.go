@@ -0,0 +1,118 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGaugeFunc(t *testing.T) {
+	n := 1.0
+	g := NewGaugeFunc(func() float64 { return n })
+	n = 2
+	if v, err := g.Get(); v != 2 || err != nil {
+		t.Errorf("g.Get() = %v, %v, want %v", v, err, 2)
+	}
+
+	p := NewGaugeFunc(func() float64 { panic("boom") })
+	if _, err := p.Get(); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("p.Get() error = %v, want panic boom", err)
+	}
+	if v := p.Values()["value"]; !math.IsNaN(v) {
+		t.Errorf("p.Values() = %v, want NaN", v)
+	}
+}
+
+func TestCounterFuncTimeout(t *testing.T) {
+	release := make(chan struct{})
+	c := NewCounterFunc(func() uint64 {
+		<-release
+		return 7
+	})
+	c.SetTimeout(10 * time.Millisecond)
+	if _, err := c.Get(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("c.Get() error = %v, want timeout", err)
+	}
+	// the timed out call is still running
+	if _, err := c.Get(); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Errorf("c.Get() error = %v, want still running", err)
+	}
+	close(release)
+	for i := 0; i < 100; i++ {
+		if v, err := c.Get(); err == nil {
+			if v != 7 {
+				t.Errorf("c.Get() = %v, want %v", v, 7)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("c.Get() still failing after the callback returned")
+}
+
+func TestGaugeFuncConcurrent(t *testing.T) {
+	g := NewGaugeFunc(func() float64 {
+		time.Sleep(time.Millisecond)
+		return 3
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if v, err := g.Get(); v != 3 || err != nil {
+					t.Errorf("g.Get() = %v, %v, want %v", v, err, 3)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFuncMetricsJSON(t *testing.T) {
+	m := NewMetricContext("test")
+	m.MustNewGaugeFunc("pool.size", func() float64 { return 4 })
+	m.MustNewCounterFunc("broken", func() uint64 { panic("boom") })
+	m.MustNewGaugeFunc("ratio", func() float64 { return math.NaN() })
+	m.MustNewGaugeFunc("ratio.inf", func() float64 { return math.Inf(1) })
+
+	// a failed callback is not an encoding error, non-finite values
+	// are, as for a Gauge
+	var buf bytes.Buffer
+	err := m.EncodeJSONWithOptions(&buf, JSONOptions{Sorted: true})
+	if failed, ok := err.(EncodeError); !ok || len(failed) != 2 ||
+		failed[0].Name != "ratio" || failed[1].Name != "ratio.inf" {
+		t.Fatalf("EncodeJSON = %v, want EncodeError for ratio and ratio.inf", err)
+	}
+	var out []struct {
+		Name  string
+		Value json.RawMessage
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 4 || out[1].Name != "pool.size" || string(out[1].Value) != "4" {
+		t.Errorf("EncodeJSON = %s, want pool.size 4", buf.String())
+	}
+	if len(out) > 0 && !strings.Contains(string(out[0].Value), `"error":"metrics: callback panicked: boom"`) {
+		t.Errorf("EncodeJSON = %s, want an error marker for broken", buf.String())
+	}
+	if len(out) == 4 && (!strings.Contains(string(out[2].Value), `"error":"json: unsupported value: NaN"`) ||
+		!strings.Contains(string(out[3].Value), `"error":"json: unsupported value: +Inf"`)) {
+		t.Errorf("EncodeJSON = %s, want error markers for ratio and ratio.inf", buf.String())
+	}
+
+	buf.Reset()
+	m.EncodeJSONWithOptions(&buf, JSONOptions{Types: []string{"counterfunc"}})
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil || len(out) != 1 || out[0].Name != "broken" {
+		t.Errorf("EncodeJSON with type counterfunc = %s, want broken", buf.String())
+	}
+}
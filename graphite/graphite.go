@@ -0,0 +1,446 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package graphite periodically sends the metrics of a MetricContext to
+// a Graphite/Carbon server over TCP, using either the plaintext or the
+// pickle protocol.
+//
+// Every metric is sent as one or more series below namespace.name:
+// Counters as name.current, name.rate and the moving averages
+// name.rate1, name.rate5 and name.rate15, BasicCounters and Gauges as
+// name, and StatsTimers and Histograms as name.count and one series per
+// percentile in PERCENTILES (name.p50, name.p99, name.p99_9, ...).
+// Other metrics are sent as one series per value, name.key, or as name
+// for a value keyed value, see metrics.Metric.
+//
+// Flushing never blocks the application: datapoints are queued in a
+// bounded buffer that a background goroutine drains, reconnecting with
+// exponential backoff while Carbon is unreachable. When the buffer is
+// full the oldest datapoints are dropped.
+//
+// Usage:
+//
+//	m := metrics.NewMetricContext("webapp")
+//	e := graphite.New(m, "carbon:2003")
+//	e.Start()
+//	defer e.Stop()
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+// default flush interval
+const FLUSH_INTERVAL = time.Minute
+
+// default maximum number of datapoints queued for sending
+const BUFFER_SIZE = 100000
+
+// default bounds for the reconnect backoff
+const MIN_BACKOFF = 100 * time.Millisecond
+const MAX_BACKOFF = time.Minute
+
+// default timeout for connecting to and writing to Carbon
+const TIMEOUT = 10 * time.Second
+
+// default maximum number of datapoints per pickle frame. Carbon rejects
+// frames larger than 1MB
+const PICKLE_BATCH = 500
+
+type Exporter struct {
+	// FlushInterval is the time between two flushes
+	FlushInterval time.Duration
+	// Pickle selects the pickle protocol instead of plaintext. Carbon
+	// listens for it on a separate port, 2004 by default
+	Pickle bool
+	// PickleBatch is the maximum number of datapoints per pickle frame
+	PickleBatch int
+	// BufferSize is the maximum number of datapoints queued for sending
+	BufferSize int
+	// MinBackoff and MaxBackoff bound the delay between two attempts
+	// to reach Carbon
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Timeout applies to connecting and to every write
+	Timeout time.Duration
+
+	m       *metrics.MetricContext
+	addr    string
+	mu      sync.Mutex
+	pending []datapoint
+	dropped uint64
+	notify  chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+	conn    net.Conn
+}
+
+type datapoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// New creates an Exporter sending the metrics of m to the Carbon
+// server at addr. No connection is made until the first send
+func New(m *metrics.MetricContext, addr string) *Exporter {
+	e := &Exporter{
+		FlushInterval: FLUSH_INTERVAL,
+		PickleBatch:   PICKLE_BATCH,
+		BufferSize:    BUFFER_SIZE,
+		MinBackoff:    MIN_BACKOFF,
+		MaxBackoff:    MAX_BACKOFF,
+		Timeout:       TIMEOUT,
+		m:             m,
+		addr:          addr,
+		notify:        make(chan struct{}, 1),
+	}
+	return e
+}
+
+// Start flushes metrics every FlushInterval, and sends them, in new
+// goroutines until Stop is called
+func (e *Exporter) Start() {
+	e.quit = make(chan struct{})
+	e.done = make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(e.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.Flush()
+			case <-e.quit:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		e.sendLoop()
+	}()
+	go func() {
+		wg.Wait()
+		close(e.done)
+	}()
+}
+
+// Stop stops the background goroutines, flushes one last time and
+// closes the connection. It makes a single attempt to send the queued
+// datapoints and returns its error
+func (e *Exporter) Stop() error {
+	if e.quit != nil {
+		close(e.quit)
+		<-e.done
+	}
+	e.Flush()
+	var err error
+	if points := e.take(); len(points) > 0 {
+		if err = e.send(points); err != nil {
+			e.requeue(points)
+		}
+	}
+	if e.conn != nil {
+		if cerr := e.conn.Close(); err == nil {
+			err = cerr
+		}
+		e.conn = nil
+	}
+	return err
+}
+
+// Flush queues the current value of all metrics passing the context's
+// OutputFilter for sending. It never blocks on the network
+func (e *Exporter) Flush() {
+	now := time.Now().Unix()
+	var points []datapoint
+	add := func(path string, v float64) {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			points = append(points, datapoint{path, v, now})
+		}
+	}
+
+	write := func(path string, v metrics.Metric) {
+		switch v := v.(type) {
+		case *metrics.Counter:
+			e.counter(add, path, v)
+		case *metrics.BasicCounter:
+			add(path, float64(v.Get()))
+		case *metrics.Gauge:
+			add(path, v.Get())
+		case *metrics.StatsTimer:
+			e.distribution(add, path, v.Count(), v.Percentile)
+		case *metrics.Histogram:
+			e.distribution(add, path, v.Count(), v.Percentile)
+		default:
+			for k, value := range v.Values() {
+				if k == "value" {
+					add(path, value)
+				} else {
+					add(path+"."+sanitize(k), value)
+				}
+			}
+		}
+	}
+
+	for name, v := range e.m.Metrics() {
+		if e.m.OutputFilter(name, v) {
+			write(e.path(name, nil), v)
+		}
+	}
+	for _, l := range append(e.m.LabeledMetrics(), e.m.Collect()...) {
+		if e.m.OutputFilter(l.Name, l.Metric) {
+			write(e.path(l.Name, l.Labels), l.Metric)
+		}
+	}
+
+	e.enqueue(points)
+}
+
+// Dropped returns the number of datapoints dropped because the send
+// buffer was full
+func (e *Exporter) Dropped() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped
+}
+
+// unexported functions
+
+func (e *Exporter) counter(add func(string, float64), path string, c *metrics.Counter) {
+	add(path+".current", float64(c.Get()))
+	add(path+".rate", c.WindowRate())
+	add(path+".rate1", c.Rate1())
+	add(path+".rate5", c.Rate5())
+	add(path+".rate15", c.Rate15())
+}
+
+func (e *Exporter) distribution(add func(string, float64), path string, count uint64,
+	percentile func(float64) (float64, error)) {
+	add(path+".count", float64(count))
+	for _, p := range metrics.PERCENTILES {
+		v, err := percentile(p)
+		if err == nil {
+			add(path+"."+metrics.PercentileKey(p), v)
+		}
+	}
+}
+
+// path returns the Carbon path for a metric. Label values of vector
+// children are appended as path components in label name order
+func (e *Exporter) path(name string, labels map[string]string) string {
+	components := []string{}
+	if ns := e.m.Namespace(); ns != "" {
+		components = append(components, sanitize(ns))
+	}
+	components = append(components, sanitize(name))
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		components = append(components, strings.Replace(sanitize(labels[k]), ".", "_", -1))
+	}
+	return strings.Join(components, ".")
+}
+
+// sanitize replaces whitespace and control characters, which would
+// break the plaintext protocol, with underscores
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// enqueue adds points to the send buffer, dropping the oldest queued
+// datapoints if it would exceed BufferSize
+func (e *Exporter) enqueue(points []datapoint) {
+	if len(points) == 0 {
+		return
+	}
+	e.mu.Lock()
+	e.pending = append(e.pending, points...)
+	if over := len(e.pending) - e.BufferSize; over > 0 {
+		e.dropped += uint64(over)
+		e.pending = append([]datapoint(nil), e.pending[over:]...)
+	}
+	e.mu.Unlock()
+
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts points that failed to send back in front of the buffer
+func (e *Exporter) requeue(points []datapoint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(points, e.pending...)
+	if over := len(e.pending) - e.BufferSize; over > 0 {
+		e.dropped += uint64(over)
+		e.pending = e.pending[over:]
+	}
+}
+
+func (e *Exporter) take() []datapoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	points := e.pending
+	e.pending = nil
+	return points
+}
+
+// sendLoop sends queued datapoints whenever new ones arrive, backing
+// off exponentially while sending fails
+func (e *Exporter) sendLoop() {
+	backoff := time.Duration(0)
+	for {
+		if backoff > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-e.quit:
+				return
+			}
+		} else {
+			select {
+			case <-e.notify:
+			case <-e.quit:
+				return
+			}
+		}
+
+		points := e.take()
+		if len(points) == 0 {
+			backoff = 0
+			continue
+		}
+		if err := e.send(points); err != nil {
+			e.requeue(points)
+			if backoff == 0 {
+				backoff = e.MinBackoff
+			} else if backoff *= 2; backoff > e.MaxBackoff {
+				backoff = e.MaxBackoff
+			}
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// send writes points to Carbon, connecting first if necessary. The
+// connection is dropped on any error
+func (e *Exporter) send(points []datapoint) error {
+	if e.conn == nil {
+		conn, err := net.DialTimeout("tcp", e.addr, e.Timeout)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+
+	var b []byte
+	if e.Pickle {
+		b = encodePickleFrames(points, e.PickleBatch)
+	} else {
+		b = encodePlaintext(points)
+	}
+
+	e.conn.SetWriteDeadline(time.Now().Add(e.Timeout))
+	w := bufio.NewWriter(e.conn)
+	_, err := w.Write(b)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+	return err
+}
+
+// encodePlaintext encodes points as "path value timestamp" lines
+func encodePlaintext(points []datapoint) []byte {
+	var b bytes.Buffer
+	for _, p := range points {
+		b.WriteString(p.path)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(p.value, 'f', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(p.timestamp, 10))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// pickle opcodes, protocol 2
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+)
+
+// encodePickleFrames encodes points as consecutive pickle frames of at
+// most batch datapoints each
+func encodePickleFrames(points []datapoint, batch int) []byte {
+	if batch <= 0 {
+		batch = PICKLE_BATCH
+	}
+	var b []byte
+	for len(points) > 0 {
+		n := batch
+		if n > len(points) {
+			n = len(points)
+		}
+		b = append(b, encodePickle(points[:n])...)
+		points = points[n:]
+	}
+	return b
+}
+
+// encodePickle encodes points as a length prefixed pickle of a list of
+// (path, (timestamp, value)) tuples, as expected by Carbon's pickle
+// receiver
+func encodePickle(points []datapoint) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 0, 0, 0}) // length header, filled in below
+	b.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	for _, p := range points {
+		b.WriteByte(pickleBinUnicode)
+		binary.Write(&b, binary.LittleEndian, uint32(len(p.path)))
+		b.WriteString(p.path)
+		b.WriteByte(pickleBinInt)
+		binary.Write(&b, binary.LittleEndian, int32(p.timestamp))
+		b.WriteByte(pickleBinFloat)
+		binary.Write(&b, binary.BigEndian, p.value)
+		b.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+	b.Write([]byte{pickleAppends, pickleStop})
+
+	out := b.Bytes()
+	binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+	return out
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2014 Square, Inc
+
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+func TestPlaintext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	m := metrics.NewMetricContext("app")
+	m.MustNewGauge("queue depth").Set(3)
+	m.MustNewCounter("requests").Add(7)
+	s := m.MustNewStatsTimer("latency", time.Millisecond, 10)
+	s.Observe(5 * time.Millisecond)
+
+	e := New(m, l.Addr().String())
+	e.Start()
+	defer e.Stop()
+	e.Flush()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	got := make(map[string]string)
+	r := bufio.NewReader(conn)
+	for len(got) < 14 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			t.Fatalf("malformed line %q", line)
+		}
+		got[f[0]] = f[1]
+	}
+
+	want := map[string]string{
+		"app.queue_depth":      "3",
+		"app.requests.current": "7",
+		"app.latency.count":    "1",
+		"app.latency.p99":      "5",
+		"app.latency.p99_9":    "5",
+	}
+	for path, v := range want {
+		if got[path] != v {
+			t.Errorf("%s = %q, want %q", path, got[path], v)
+		}
+	}
+	for _, rate := range []string{"rate", "rate1", "rate5", "rate15"} {
+		if _, ok := got["app.requests."+rate]; !ok {
+			t.Errorf("app.requests.%s not sent", rate)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	m := metrics.NewMetricContext("app")
+	m.MustNewGauge("queue").Set(3)
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	// the final flush is sent although the interval never elapsed
+	e := New(m, l.Addr().String())
+	e.Start()
+	if err := e.Stop(); err != nil {
+		t.Errorf("e.Stop() = %v, want nil", err)
+	}
+	if line := <-received; !strings.HasPrefix(line, "app.queue 3 ") {
+		t.Errorf("received %q, want app.queue 3", line)
+	}
+
+	// nothing listening
+	e = New(m, "127.0.0.1:1")
+	if err := e.Stop(); err == nil {
+		t.Errorf("e.Stop() = nil, want a connection error")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	// reserve an address nobody is listening on yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	m := metrics.NewMetricContext("app")
+	m.MustNewBasicCounter("events").Add(1)
+
+	e := New(m, addr)
+	e.MinBackoff = 10 * time.Millisecond
+	e.MaxBackoff = 20 * time.Millisecond
+	e.Start()
+	defer e.Stop()
+	e.Flush()
+
+	time.Sleep(50 * time.Millisecond)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("address reused: ", err)
+	}
+	defer l.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "app.events 1 ") {
+		t.Errorf("line = %q, %v, want app.events 1", line, err)
+	}
+}
+
+func TestBoundedBuffer(t *testing.T) {
+	m := metrics.NewMetricContext("app")
+	m.MustNewBasicCounter("a")
+	m.MustNewBasicCounter("b")
+
+	e := New(m, "127.0.0.1:1")
+	e.BufferSize = 3
+	e.Flush()
+	e.Flush()
+
+	if e.Dropped() != 1 {
+		t.Errorf("e.Dropped() = %v, want %v", e.Dropped(), 1)
+	}
+	if len(e.pending) != 3 {
+		t.Errorf("len(e.pending) = %v, want %v", len(e.pending), 3)
+	}
+}
+
+func TestPickle(t *testing.T) {
+	b := encodePickle([]datapoint{{"a.b", 1.5, 1400000000}})
+	want := []byte("\x00\x00\x00\x1e\x80\x02](X\x03\x00\x00\x00a.b" +
+		"J\x00\x4e\x72\x53G\x3f\xf8\x00\x00\x00\x00\x00\x00\x86\x86e.")
+	if !bytes.Equal(b, want) {
+		t.Errorf("encodePickle() = %q, want %q", b, want)
+	}
+}
+
+func TestPickleFrames(t *testing.T) {
+	points := make([]datapoint, 1201)
+	for i := range points {
+		points[i] = datapoint{"a.b", float64(i), 1400000000}
+	}
+	b := encodePickleFrames(points, 500)
+
+	// frames hold 500, 500 and 201 datapoints
+	var sizes []int
+	for len(b) > 0 {
+		n := int(binary.BigEndian.Uint32(b))
+		sizes = append(sizes, bytes.Count(b[4:4+n], []byte("a.b")))
+		b = b[4+n:]
+	}
+	if len(sizes) != 3 || sizes[0] != 500 || sizes[1] != 500 || sizes[2] != 201 {
+		t.Errorf("frame sizes = %v, want [500 500 201]", sizes)
+	}
+
+	if b := encodePickleFrames(points[:1], 500); !bytes.Equal(b, encodePickle(points[:1])) {
+		t.Errorf("encodePickleFrames() of one datapoint = %q, want a single frame", b)
+	}
+}
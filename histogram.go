@@ -0,0 +1,229 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/* Histogram
+
+A Histogram counts observations into a fixed set of buckets. Unlike
+StatsTimer it never forgets an observation, and bucket counts from
+several hosts can be summed to aggregate them. All updates are lock-free.
+Arguments:
+  timeUnit time.Duration - time unit observations and buckets are in
+  buckets []float64 - upper bounds (inclusive) of the buckets; an
+                      overflow bucket for larger values is implicit
+
+Example use:
+  m := metrics.NewMetricContext("webapp")
+  h := m.MustNewHistogram("latency", time.Millisecond,
+	  metrics.ExponentialBuckets(1, 2, 12))
+
+  func (wa *WebApp)  HandleQuery(w http.ResponseWriter, r *http.Request) {
+	  stopWatch := h.Start()
+	  .....
+	  h.Stop(stopWatch)
+  }
+
+  pctile_95th, err := h.Percentile(95)
+
+*/
+
+type Histogram struct {
+	bounds   []float64
+	counts   []uint64
+	count    uint64
+	sum      uint64 // float64 bits
+	timeUnit time.Duration
+}
+
+// NewHistogram initializes a Histogram with the given bucket upper
+// bounds and returns it. buckets does not need to be sorted
+func NewHistogram(timeUnit time.Duration, buckets []float64) *Histogram {
+	h := new(Histogram)
+	h.timeUnit = timeUnit
+	h.bounds = make([]float64, len(buckets))
+	copy(h.bounds, buckets)
+	sort.Float64s(h.bounds)
+	h.counts = make([]uint64, len(h.bounds)+1)
+	h.Reset()
+	return h
+}
+
+// LinearBuckets returns count bucket bounds, the first being start and
+// each following one width larger than the previous
+func LinearBuckets(start, width float64, count int) []float64 {
+	b := make([]float64, count)
+	for i := range b {
+		b[i] = start + float64(i)*width
+	}
+	return b
+}
+
+// ExponentialBuckets returns count bucket bounds, the first being start
+// and each following one factor times larger than the previous
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	b := make([]float64, count)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
+
+// Reset all bucket counts, the count and the sum to zero
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.count, 0)
+	atomic.StoreUint64(&h.sum, math.Float64bits(0))
+}
+
+// Observe records value v, expressed in the histogram's time unit
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) Start() *Timer {
+	t := NewTimer()
+	t.Start()
+	return t
+}
+
+// Stop stops timer t and records the elapsed time. It returns the
+// elapsed time in the histogram's time unit
+func (h *Histogram) Stop(t *Timer) float64 {
+	v := float64(t.Stop()) / float64(h.timeUnit.Nanoseconds())
+	h.Observe(v)
+	return v
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of all observations
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+// Buckets returns the bucket upper bounds and the number of
+// observations in each bucket. counts has one more element than bounds,
+// holding the observations larger than the last bound
+func (h *Histogram) Buckets() (bounds []float64, counts []uint64) {
+	counts = make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return h.bounds, counts
+}
+
+// Percentile estimates the given percentile from the bucket counts by
+// linear interpolation within the bucket the percentile falls into.
+// Values in the overflow bucket are reported as the largest bound
+func (h *Histogram) Percentile(percentile float64) (float64, error) {
+	if percentile > 100 {
+		return math.NaN(), errors.New("Invalid argument")
+	}
+
+	_, counts := h.Buckets()
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return math.NaN(), errors.New("No values")
+	}
+
+	rank := (percentile / 100) * float64(total)
+	var cumulative uint64
+	for i, c := range counts {
+		if c == 0 || float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+		if i == len(h.bounds) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.bounds[i-1]
+		} else if h.bounds[0] < 0 {
+			lower = h.bounds[0]
+		}
+		upper := h.bounds[i]
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c), nil
+	}
+	if len(h.bounds) == 0 {
+		return math.NaN(), errors.New("No buckets")
+	}
+	return h.bounds[len(h.bounds)-1], nil
+}
+
+// MarshalJSON returns a byte slice containing representation of
+// Histogram. Bucket counts are cumulative, as in the Prometheus
+// histogram format
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	return h.marshalJSON(PERCENTILES)
+}
+
+// unexported functions
+
+// marshalJSON is MarshalJSON reporting percentiles ps
+func (h *Histogram) marshalJSON(ps []float64) ([]byte, error) {
+	type bucketData struct {
+		UpperBound string
+		Count      uint64
+	}
+	bounds, counts := h.Buckets()
+	buckets := make([]bucketData, len(counts))
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		buckets[i].Count = cumulative
+		if i < len(bounds) {
+			buckets[i].UpperBound = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		} else {
+			buckets[i].UpperBound = "+Inf"
+		}
+	}
+
+	var pctiles []percentileJSON
+	for _, p := range ps {
+		percentile, err := h.Percentile(p)
+		if err == nil {
+			pctiles = append(pctiles, percentileJSON{formatPercentile(p), percentile})
+		}
+	}
+	data := struct {
+		Count       uint64
+		Sum         float64
+		Buckets     []bucketData
+		Percentiles []percentileJSON
+	}{
+		cumulative,
+		h.Sum(),
+		buckets,
+		pctiles,
+	}
+	return json.Marshal(data)
+}
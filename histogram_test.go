@@ -0,0 +1,93 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	l := LinearBuckets(1, 2, 3)
+	if l[0] != 1 || l[1] != 3 || l[2] != 5 {
+		t.Errorf("LinearBuckets(1, 2, 3) = %v, want [1 3 5]", l)
+	}
+	e := ExponentialBuckets(1, 10, 3)
+	if e[0] != 1 || e[1] != 10 || e[2] != 100 {
+		t.Errorf("ExponentialBuckets(1, 10, 3) = %v, want [1 10 100]", e)
+	}
+}
+
+func TestHistogramObserve(t *testing.T) {
+	h := NewHistogram(time.Millisecond, LinearBuckets(10, 10, 10))
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		x := float64(i + 1)
+		go func() {
+			defer wg.Done()
+			h.Observe(x)
+		}()
+	}
+	wg.Wait()
+
+	if h.Count() != 100 {
+		t.Errorf("h.Count() = %v, want %v", h.Count(), 100)
+	}
+	if h.Sum() != 5050 {
+		t.Errorf("h.Sum() = %v, want %v", h.Sum(), 5050)
+	}
+	_, counts := h.Buckets()
+	for i, c := range counts[:10] {
+		if c != 10 {
+			t.Errorf("bucket %d count = %v, want %v", i, c, 10)
+		}
+	}
+
+	pctile, err := h.Percentile(75)
+	if math.Abs(pctile-75) > 1 || err != nil {
+		t.Errorf("h.Percentile(75) = %v, want %v", pctile, 75)
+	}
+	h.Observe(1000)
+	pctile, _ = h.Percentile(100)
+	if pctile != 100 {
+		t.Errorf("h.Percentile(100) = %v, want %v", pctile, 100)
+	}
+}
+
+func TestHistogramNoValues(t *testing.T) {
+	h := NewHistogram(time.Millisecond, LinearBuckets(1, 1, 5))
+	if _, err := h.Percentile(50); err == nil {
+		t.Errorf("h.Percentile(50) on empty histogram, want error")
+	}
+}
+
+func TestHistogramPrometheus(t *testing.T) {
+	m := NewMetricContext("test")
+	h := m.MustNewHistogram("latency", time.Millisecond, []float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(3)
+	h.Observe(7)
+
+	var buf bytes.Buffer
+	if err := m.EncodePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{
+		"# TYPE test_latency histogram\n",
+		`test_latency_bucket{le="1"} 1` + "\n",
+		`test_latency_bucket{le="5"} 2` + "\n",
+		`test_latency_bucket{le="+Inf"} 3` + "\n",
+		"test_latency_sum 10.5\n",
+		"test_latency_count 3\n",
+	} {
+		if !strings.Contains(buf.String(), w) {
+			t.Errorf("EncodePrometheus() missing %q in:\n%s", w, buf.String())
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EncodeInflux writes all metrics passing filter to writer w in the
+// InfluxDB line protocol, one line per metric. The measurement is the
+// metric name prefixed with the context namespace, labels of vector
+// children are written as tags, and the fields depend on the type:
+//
+//	Counter:       current, rate, rate1, rate5, rate15
+//	BasicCounter:  value
+//	UpDownCounter: value
+//	Gauge:         value
+//	StatsTimer:    count, sum, min, max, mean, stddev, p50, p75, ..., p99_999
+//	Histogram:     count, sum, p50, p75, ..., p99_999
+//	other kinds:   the keys of Metric.Values
+//
+// All lines share the timestamp of the call.
+func (m *MetricContext) EncodeInflux(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	write := func(name string, labels map[string]string, v Metric) {
+		if !m.OutputFilter(name, v) {
+			return
+		}
+		fields := influxFields(v)
+		if len(fields) == 0 {
+			return
+		}
+		bw.WriteString(escapeInflux(m.fullName(name), ", "))
+		for _, k := range sortedLabelNames(labels) {
+			bw.WriteString("," + escapeInflux(k, ",= ") + "=" + escapeInflux(labels[k], ",= "))
+		}
+		bw.WriteString(" " + strings.Join(fields, ",") + " " + ts + "\n")
+	}
+
+	for name, v := range m.Metrics() {
+		write(name, nil, v)
+	}
+	for _, l := range append(m.LabeledMetrics(), m.Collect()...) {
+		write(l.Name, l.Labels, l.Metric)
+	}
+	return bw.Flush()
+}
+
+// unexported functions
+
+// influxFields returns the key=value field set of v. Fields with a
+// NaN or infinite value are left out, as line protocol cannot represent
+// them
+func influxFields(v Metric) []string {
+	var fields []string
+	float := func(key string, f float64) {
+		if !math.IsNaN(f) && !math.IsInf(f, 0) {
+			fields = append(fields, key+"="+strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	}
+	integer := func(key string, i uint64) {
+		if i > math.MaxInt64 {
+			i = math.MaxInt64
+		}
+		fields = append(fields, key+"="+strconv.FormatUint(i, 10)+"i")
+	}
+	percentiles := func(values []float64) {
+		for i, p := range values {
+			float(PercentileKey(PERCENTILES[i]), p)
+		}
+	}
+
+	switch v := v.(type) {
+	case *Counter:
+		integer("current", v.Get())
+		float("rate", v.WindowRate())
+		float("rate1", v.Rate1())
+		float("rate5", v.Rate5())
+		float("rate15", v.Rate15())
+	case *BasicCounter:
+		integer("value", v.Get())
+	case *UpDownCounter:
+		fields = append(fields, "value="+strconv.FormatInt(v.Get(), 10)+"i")
+	case *Gauge:
+		float("value", v.Get())
+	case *StatsTimer:
+		total := v.CumulativeStats()
+		integer("count", total.Count)
+		float("sum", total.Sum)
+		st := v.Stats()
+		if st.Count > 0 {
+			float("min", st.Min)
+			float("max", st.Max)
+			float("mean", st.Mean)
+			float("stddev", st.StdDev)
+		}
+		values, _ := v.percentiles(PERCENTILES)
+		percentiles(values)
+	case *Histogram:
+		integer("count", v.Count())
+		float("sum", v.Sum())
+		for _, p := range PERCENTILES {
+			if pctile, err := v.Percentile(p); err == nil {
+				float(PercentileKey(p), pctile)
+			}
+		}
+	default:
+		values := v.Values()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			float(escapeInflux(k, ",= "), values[k])
+		}
+	}
+	return fields
+}
+
+// escapeInflux backslash escapes every character of chars in s
+func escapeInflux(s string, chars string) string {
+	for _, c := range chars {
+		s = strings.Replace(s, string(c), `\`+string(c), -1)
+	}
+	return s
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package influx periodically writes the metrics of a MetricContext to
+// the InfluxDB HTTP /write API, in the line protocol produced by
+// MetricContext.EncodeInflux.
+//
+// Usage:
+//
+//	m := metrics.NewMetricContext("webapp")
+//	w := influx.New(m, "http://localhost:8086/write?db=metrics")
+//	w.Gzip = true
+//	w.Start()
+//	defer w.Stop()
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+// default write interval
+const INTERVAL = 10 * time.Second
+
+// default maximum number of lines per request
+const BATCH_SIZE = 5000
+
+// default number of retries of a failed request
+const RETRIES = 3
+
+// default delay before the first retry; doubled on every retry
+const RETRY_DELAY = time.Second
+
+// default HTTP timeout
+const TIMEOUT = 10 * time.Second
+
+type Writer struct {
+	// Interval is the time between two writes
+	Interval time.Duration
+	// BatchSize is the maximum number of lines sent in one request
+	BatchSize int
+	// Gzip compresses request bodies
+	Gzip bool
+	// Retries is the number of times a request failing with a network
+	// error or a 5xx status is retried
+	Retries int
+	// RetryDelay is the delay before the first retry. It doubles with
+	// every further retry
+	RetryDelay time.Duration
+	// Client is used for all requests
+	Client *http.Client
+	// ErrorHandler is called with errors of writes run by Start.
+	// Errors are discarded if it is nil
+	ErrorHandler func(error)
+
+	m    *metrics.MetricContext
+	url  string
+	quit chan struct{}
+	done chan struct{}
+}
+
+// New creates a Writer posting the metrics of m to url, the /write
+// endpoint including its query parameters, e.g.
+// http://localhost:8086/write?db=metrics
+func New(m *metrics.MetricContext, url string) *Writer {
+	w := &Writer{
+		Interval:   INTERVAL,
+		BatchSize:  BATCH_SIZE,
+		Retries:    RETRIES,
+		RetryDelay: RETRY_DELAY,
+		Client:     &http.Client{Timeout: TIMEOUT},
+		m:          m,
+		url:        url,
+	}
+	return w
+}
+
+// Start writes metrics every Interval in a new goroutine until Stop
+// is called
+func (w *Writer) Start() {
+	w.quit = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.Write(); err != nil && w.ErrorHandler != nil {
+					w.ErrorHandler(err)
+				}
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the write goroutine and writes one last time. It returns
+// the error of the final write
+func (w *Writer) Stop() error {
+	if w.quit != nil {
+		close(w.quit)
+		<-w.done
+	}
+	return w.Write()
+}
+
+// Write sends the current value of all metrics passing the context's
+// OutputFilter, in batches of at most BatchSize lines. It returns the
+// first error of a batch that still failed after all retries
+func (w *Writer) Write() error {
+	var buf bytes.Buffer
+	if err := w.m.EncodeInflux(&buf); err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(buf.Bytes(), []byte("\n"))
+
+	var err error
+	for len(lines) > 0 && len(lines[0]) > 0 {
+		n := w.BatchSize
+		if n < 1 || n > len(lines) {
+			n = len(lines)
+		}
+		if berr := w.post(bytes.Join(lines[:n], nil)); err == nil {
+			err = berr
+		}
+		lines = lines[n:]
+	}
+	return err
+}
+
+// unexported functions
+
+// post sends a single batch, retrying on network errors and 5xx
+// responses
+func (w *Writer) post(batch []byte) error {
+	body := batch
+	if w.Gzip {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write(batch)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		body = b.Bytes()
+	}
+
+	delay := w.RetryDelay
+	var err error
+	for attempt := 0; attempt <= w.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retry bool
+		retry, err = w.send(body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// send makes a single request. It returns whether a failed request
+// should be retried
+func (w *Writer) send(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode >= 500, fmt.Errorf("influx: %s: %s", resp.Status, msg)
+	}
+	return false, nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2014 Square, Inc
+
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+func TestWrite(t *testing.T) {
+	var requests, lines int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Content-Encoding = %q, want gzip", r.Header.Get("Content-Encoding"))
+		}
+		if r.URL.Query().Get("db") != "metrics" {
+			t.Errorf("db = %q, want metrics", r.URL.Query().Get("db"))
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(gz)
+		lines += strings.Count(string(b), "\n")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetricContext("app")
+	for _, name := range []string{"a", "b", "c"} {
+		m.MustNewBasicCounter(name).Add(1)
+	}
+
+	w := New(m, server.URL+"/write?db=metrics")
+	w.Gzip = true
+	w.BatchSize = 2
+	w.RetryDelay = time.Millisecond
+	if err := w.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	// one failed attempt, its retry and a second batch
+	if requests != 3 || lines != 3 {
+		t.Errorf("requests, lines = %v, %v, want 3, 3", requests, lines)
+	}
+}
+
+func TestWriteClientError(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "bad line", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetricContext("app")
+	m.MustNewBasicCounter("a")
+	w := New(m, server.URL+"/write?db=metrics")
+	w.RetryDelay = time.Millisecond
+
+	if err := w.Write(); err == nil {
+		t.Errorf("w.Write() = nil, want error for status 400")
+	}
+	if requests != 1 {
+		t.Errorf("requests = %v, want 1; client errors must not be retried", requests)
+	}
+}
+
+func TestStop(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetricContext("app")
+	m.MustNewBasicCounter("a")
+
+	// the final write is sent although the interval never elapsed
+	w := New(m, server.URL+"/write?db=metrics")
+	w.Start()
+	if err := w.Stop(); err != nil {
+		t.Errorf("w.Stop() = %v, want nil", err)
+	}
+	if requests != 1 {
+		t.Errorf("requests = %v, want 1", requests)
+	}
+}
+
+func TestBatchSplit(t *testing.T) {
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, b)
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetricContext("app")
+	m.MustNewBasicCounter("a")
+	w := New(m, server.URL)
+	if err := w.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 || !bytes.HasPrefix(bodies[0], []byte("app.a value=0i ")) {
+		t.Errorf("bodies = %q, want a single app.a line", bodies)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeInflux(t *testing.T) {
+	m := NewMetricContext("web app")
+	m.MustNewBasicCounter("events").Add(3)
+	m.MustNewGauge("queue").Set(1.5)
+	m.MustNewGauge("unset")
+	s := m.MustNewStatsTimer("latency", time.Millisecond, 10)
+	s.Observe(2 * time.Millisecond)
+	v := NewGaugeVec("endpoint")
+	m.Register(v, "inflight")
+	v.With("endpoint", "/a b").Set(2)
+
+	var buf bytes.Buffer
+	if err := m.EncodeInflux(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4:\n%s", len(lines), buf.String())
+	}
+
+	want := []string{
+		`web\ app.events value=3i `,
+		`web\ app.queue value=1.5 `,
+		`web\ app.latency count=1i,sum=2,min=2,max=2,mean=2,stddev=0,p50=2,`,
+		`web\ app.inflight,endpoint=/a\ b value=2 `,
+	}
+	for _, w := range want {
+		if !strings.Contains(buf.String(), "\n"+w) && !strings.HasPrefix(buf.String(), w) {
+			t.Errorf("EncodeInflux() missing %q in:\n%s", w, buf.String())
+		}
+	}
+}
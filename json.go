@@ -3,10 +3,16 @@
 package metrics
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 // XXX: evaluate merging the types with individual definitions
@@ -15,54 +21,408 @@ import (
 
 // MetricJSON is a type for serializing any metric type
 type MetricJSON struct {
-	Type  string
-	Name  string
-	Value interface{}
+	Type   string
+	Name   string
+	Labels map[string]string `json:",omitempty"`
+	Value  interface{}
+	// Error describes a failure the metric reports next to its value,
+	// e.g. the error of a failed collection for collect_error
+	Error string `json:",omitempty"`
+}
+
+// percentileJSON is the serialized form of a single percentile
+type percentileJSON struct {
+	Percentile string
+	Value      float64
+}
+
+func formatPercentile(p float64) string {
+	return fmt.Sprintf("%.6f", p)
+}
+
+// JSONOptions controls the output of EncodeJSONWithOptions
+type JSONOptions struct {
+	// Prefix restricts the output to metrics whose dotted name is
+	// Prefix or falls under it, e.g. "db.innodb" matches
+	// "db.innodb.rows" but not "db.innodb_rows"
+	Prefix string
+	// Nested renders the metrics as a JSON object tree keyed by the
+	// dot separated components of their names instead of a flat list.
+	// A metric is the value at the key of its last name component,
+	// or an array of metrics for the children of a vector. If a name is
+	// also the prefix of other names, its metric is moved to the key "."
+	// below it
+	Nested bool
+	// Types restricts the output to the given metric kinds, see
+	// Metric: counter, basiccounter, gauge, statstimer, histogram,
+	// updowncounter, floatcounter, gaugefunc, counterfunc or the kind
+	// of a custom metric. Kinds match exactly, so gauge does not select
+	// gaugefunc. Children of vectors are selected by their own kind
+	Types []string
+	// Match, if set, restricts the output to metrics whose name it
+	// matches
+	Match *regexp.Regexp
+	// Exclude, if set, removes metrics whose name it matches
+	Exclude *regexp.Regexp
+	// Pretty indents the output
+	Pretty bool
+	// Percentiles overrides PERCENTILES for StatsTimers and Histograms
+	Percentiles []float64
+	// Sorted emits metrics ordered by kind, then name, then
+	// labels instead of in random order. Implied by Pretty
+	Sorted bool
+	// OnError, if set, is called for every metric that fails to
+	// marshal, instead of the encoder returning an EncodeError
+	OnError func(*MetricError)
+}
+
+// MetricError describes a metric that failed to marshal
+type MetricError struct {
+	Name   string
+	Labels map[string]string
+	Err    error
+}
+
+func (e *MetricError) Error() string {
+	name := e.Name
+	if len(e.Labels) > 0 {
+		name += "{" + labelString(e.Labels) + "}"
+	}
+	return name + ": " + e.Err.Error()
+}
+
+// EncodeError is returned by the JSON encoders if some metrics failed
+// to marshal. They are written with {"error": "..."} as their value,
+// all other metrics are written as usual and the output is valid JSON
+type EncodeError []*MetricError
+
+func (e EncodeError) Error() string {
+	if len(e) == 1 {
+		return "metrics: failed to marshal " + e[0].Error()
+	}
+	return fmt.Sprintf("metrics: failed to marshal %d metrics, first %v", len(e), e[0])
+}
+
+// selects reports whether o selects the metric v named name. The
+// context's OutputFilter is applied separately
+func (o *JSONOptions) selects(name string, v Metric) bool {
+	if o.Prefix != "" && name != o.Prefix && !strings.HasPrefix(name, o.Prefix+".") {
+		return false
+	}
+	if o.Match != nil && !o.Match.MatchString(name) {
+		return false
+	}
+	if o.Exclude != nil && o.Exclude.MatchString(name) {
+		return false
+	}
+	if len(o.Types) == 0 {
+		return true
+	}
+	t := v.Kind()
+	for _, want := range o.Types {
+		if strings.ToLower(want) == t {
+			return true
+		}
+	}
+	return false
 }
 
 // EncodeJSON is a streaming encoder that writes all metrics passing filter
-// to writer w as JSON
+// to writer w as JSON. It returns the first error writing to w, or an
+// EncodeError if some metrics failed to marshal
 func (m *MetricContext) EncodeJSON(w io.Writer) error {
-	w.Write([]byte("["))
+	return m.EncodeJSONWithOptions(w, JSONOptions{})
+}
+
+// EncodeJSONWithOptions writes all metrics passing filter and
+// selected by o to writer w as JSON. Errors are returned as by
+// EncodeJSON
+func (m *MetricContext) EncodeJSONWithOptions(w io.Writer, o JSONOptions) error {
+	if o.Pretty {
+		var buf bytes.Buffer
+		o.Pretty = false
+		o.Sorted = true
+		encodeErr := m.EncodeJSONWithOptions(&buf, o)
+		if _, ok := encodeErr.(EncodeError); encodeErr != nil && !ok {
+			return encodeErr
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+			return err
+		}
+		if _, err := out.WriteTo(w); err != nil {
+			return err
+		}
+		return encodeErr
+	}
+	if o.Nested {
+		return m.encodeNestedJSON(w, o)
+	}
+
+	var failed EncodeError
+	if _, err := w.Write([]byte("[")); err != nil {
+		return err
+	}
 	// JSON disallows trailing-comma
 	prependComma := false
-	for name, c := range m.Counters {
-		m.writeJSON(w, name, c, &prependComma)
+	for _, e := range m.jsonEntries(o) {
+		if err := m.writeJSON(w, e, o, &prependComma, &failed); err != nil {
+			return err
+		}
 	}
+	if _, err := w.Write([]byte("]")); err != nil {
+		return err
+	}
+	return failed.err()
+}
+
+// unexported functions
+
+// jsonEntry is a metric selected for JSON output
+type jsonEntry struct {
+	name   string
+	labels map[string]string
+	v      Metric
+}
 
-	for name, c := range m.BasicCounters {
-		m.writeJSON(w, name, c, &prependComma)
+// jsonEntries returns all metrics selected by o, in output order
+func (m *MetricContext) jsonEntries(o JSONOptions) []jsonEntry {
+	var entries []jsonEntry
+	add := func(name string, labels map[string]string, v Metric) {
+		if o.selects(name, v) {
+			entries = append(entries, jsonEntry{name, labels, v})
+		}
 	}
-	for name, g := range m.Gauges {
-		m.writeJSON(w, name, g, &prependComma)
+
+	if o.Sorted || o.Pretty {
+		registered := m.sortedEntries()
+		labeled := append(m.LabeledMetrics(), m.Collect()...)
+		sort.Sort(labeledMetricsByType(labeled))
+		// merge the two sorted lists
+		for len(registered) > 0 || len(labeled) > 0 {
+			if len(labeled) == 0 || (len(registered) > 0 &&
+				!entryLess(labeled[0].Name, labeled[0].Metric, registered[0].name, registered[0].v)) {
+				add(registered[0].name, nil, registered[0].v)
+				registered = registered[1:]
+			} else {
+				add(labeled[0].Name, labeled[0].Labels, labeled[0].Metric)
+				labeled = labeled[1:]
+			}
+		}
+		return entries
 	}
 
-	for name, s := range m.StatsTimers {
-		m.writeJSON(w, name, s, &prependComma)
+	for name, v := range m.Metrics() {
+		add(name, nil, v)
 	}
-	w.Write([]byte("]"))
-	return nil
+	for _, l := range m.LabeledMetrics() {
+		add(l.Name, l.Labels, l.Metric)
+	}
+	for _, l := range m.Collect() {
+		add(l.Name, l.Labels, l.Metric)
+	}
+	return entries
 }
 
-// unexported functions
-func (m *MetricContext) writeJSON(w io.Writer, name string, v interface{}, prependComma *bool) {
-	b, err := m.marshalMetricJSON(name, v)
-	if err == nil {
-		if *prependComma {
-			w.Write([]byte(","))
+// sortedEntries returns all registered metrics, except vectors, sorted
+// by kind and name. The list is cached until the next change to
+// the registry and must not be modified
+func (m *MetricContext) sortedEntries() []jsonEntry {
+	m.mu.RLock()
+	sorted := m.sorted
+	m.mu.RUnlock()
+	if sorted != nil {
+		return sorted
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sorted != nil {
+		return m.sorted
+	}
+	sorted = make([]jsonEntry, 0)
+	for name, v := range m.metrics {
+		sorted = append(sorted, jsonEntry{name, nil, v})
+	}
+	sort.Sort(jsonEntriesByType(sorted))
+	m.sorted = sorted
+	return sorted
+}
+
+// entryLess orders metrics by kind, then by name
+func entryLess(name1 string, v1 Metric, name2 string, v2 Metric) bool {
+	t1, t2 := v1.Kind(), v2.Kind()
+	if t1 != t2 {
+		return t1 < t2
+	}
+	return name1 < name2
+}
+
+type jsonEntriesByType []jsonEntry
+
+func (a jsonEntriesByType) Len() int      { return len(a) }
+func (a jsonEntriesByType) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a jsonEntriesByType) Less(i, j int) bool {
+	return entryLess(a[i].name, a[i].v, a[j].name, a[j].v)
+}
+
+// labeledMetricsByType orders by kind, then by name and label values
+type labeledMetricsByType []LabeledMetric
+
+func (a labeledMetricsByType) Len() int      { return len(a) }
+func (a labeledMetricsByType) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a labeledMetricsByType) Less(i, j int) bool {
+	if a[i].Metric.Kind() != a[j].Metric.Kind() {
+		return a[i].Metric.Kind() < a[j].Metric.Kind()
+	}
+	return labeledMetrics(a).Less(i, j)
+}
+
+// writeJSON writes entry e, preceded by a comma if prependComma is
+// set. It only returns errors writing to w; metrics that fail to
+// marshal are reported by marshalEntry and written as errors
+func (m *MetricContext) writeJSON(w io.Writer, e jsonEntry, o JSONOptions, prependComma *bool, failed *EncodeError) error {
+	b, ok := m.marshalEntry(e, o, failed)
+	if !ok {
+		return nil
+	}
+	if *prependComma {
+		if _, err := w.Write([]byte(",")); err != nil {
+			return err
+		}
+	}
+	*prependComma = true
+	_, err := w.Write(b)
+	return err
+}
+
+// marshalEntry marshals entry e. Metrics that fail to marshal, e.g.
+// Gauges set to an infinite value, are passed to o.OnError, or added to
+// failed if it is not set, and marshaled with an error marker as value
+func (m *MetricContext) marshalEntry(e jsonEntry, o JSONOptions, failed *EncodeError) ([]byte, bool) {
+	b, err := m.marshalMetricJSON(e.name, e.labels, e.v, o.Percentiles)
+	if err == errFiltered {
+		return nil, false
+	}
+	if err != nil {
+		if merr, ok := err.(*json.MarshalerError); ok {
+			err = merr.Err
+		}
+		merr := &MetricError{e.name, e.labels, err}
+		if o.OnError != nil {
+			o.OnError(merr)
+		} else {
+			*failed = append(*failed, merr)
+		}
+		marker, _ := errorMarkerJSON(err)
+		b, err = json.Marshal(&MetricJSON{Type: reflect.TypeOf(e.v).String(), Name: e.name,
+			Labels: e.labels, Value: json.RawMessage(marker)})
+		if err != nil {
+			return nil, false
 		}
-		w.Write(b)
-		*prependComma = true
 	}
+	return b, true
+}
+
+func (e EncodeError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
 }
 
-func (m *MetricContext) marshalMetricJSON(name string, v interface{}) ([]byte, error) {
+// jsonNode is a branch of the nested JSON tree
+type jsonNode map[string]interface{}
+
+func (m *MetricContext) encodeNestedJSON(w io.Writer, o JSONOptions) error {
+	var failed EncodeError
+	root := make(jsonNode)
+	for _, e := range m.jsonEntries(o) {
+		if b, ok := m.marshalEntry(e, o, &failed); ok {
+			root.insert(strings.Split(e.name, "."), json.RawMessage(b))
+		}
+	}
+	b, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(b); err != nil {
+		return err
+	}
+	return failed.err()
+}
+
+// insert adds metric at the node addressed by path, creating branches
+// as needed
+func (n jsonNode) insert(path []string, metric json.RawMessage) {
+	key := path[0]
+	if len(path) > 1 {
+		child, ok := n[key].(jsonNode)
+		if !ok {
+			child = make(jsonNode)
+			if leaf, exists := n[key]; exists {
+				// key was a metric so far, keep it below the branch
+				child["."] = leaf
+			}
+			n[key] = child
+		}
+		child.insert(path[1:], metric)
+		return
+	}
+
+	if child, ok := n[key].(jsonNode); ok {
+		child.insert([]string{"."}, metric)
+		return
+	}
+	switch leaf := n[key].(type) {
+	case nil:
+		n[key] = metric
+	case json.RawMessage:
+		n[key] = []json.RawMessage{leaf, metric}
+	case []json.RawMessage:
+		n[key] = append(leaf, metric)
+	}
+}
+
+// errFiltered is returned by marshalMetricJSON for metrics left out
+// on purpose: rejected by the OutputFilter, or Gauges never set
+var errFiltered = errors.New("filtered")
+
+// marshalMetricJSON marshals a single metric. ps, if not empty,
+// overrides PERCENTILES
+func (m *MetricContext) marshalMetricJSON(name string, labels map[string]string, v Metric, ps []float64) ([]byte, error) {
 	o := new(MetricJSON)
 	if !m.OutputFilter(name, v) {
-		return nil, errors.New("filtered")
+		return nil, errFiltered
+	}
+	if g, ok := v.(*Gauge); ok && math.IsNaN(g.Get()) {
+		return nil, errFiltered
 	}
 	o.Type = reflect.TypeOf(v).String()
 	o.Name = name
+	o.Labels = labels
 	o.Value = v
+	if r, ok := v.(errorReporter); ok && r.Err() != nil {
+		o.Error = r.Err().Error()
+	}
+	if len(ps) > 0 {
+		switch v := v.(type) {
+		case *StatsTimer:
+			o.Value = percentilesJSON{v.marshalJSON, ps}
+		case *Histogram:
+			o.Value = percentilesJSON{v.marshalJSON, ps}
+		}
+	}
 	return json.Marshal(o)
 }
+
+// percentilesJSON marshals a metric reporting a custom set of
+// percentiles
+type percentilesJSON struct {
+	marshal func(ps []float64) ([]byte, error)
+	ps      []float64
+}
+
+func (p percentilesJSON) MarshalJSON() ([]byte, error) {
+	return p.marshal(p.ps)
+}
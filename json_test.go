@@ -3,6 +3,13 @@
 package metrics
 
 import "testing"
+import "bytes"
+import "encoding/json"
+import "sort"
+import "errors"
+import "io/ioutil"
+import "math"
+import "time"
 import "strings"
 import "net/http"
 import "net/http/httptest"
@@ -25,3 +32,252 @@ func TestJsonHandler(t *testing.T) {
 			response.Body.String())
 	}
 }
+
+func TestJsonHandlerPrefix(t *testing.T) {
+	m := NewMetricContext("test")
+	m.MustNewGauge("db.innodb.rows").Set(1)
+	m.MustNewGauge("db.innodb_rows").Set(2)
+	m.MustNewGauge("db.queries").Set(3)
+
+	req, err := http.NewRequest("GET", "/api/v1/metrics.json/db/innodb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := httptest.NewRecorder()
+	m.HttpJsonHandler(response, req)
+
+	var out []MetricJSON
+	if err := json.Unmarshal(response.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].Name != "db.innodb.rows" {
+		t.Errorf("response = %v, want only db.innodb.rows", response.Body.String())
+	}
+}
+
+func TestNestedJSON(t *testing.T) {
+	m := NewMetricContext("test")
+	m.MustNewGauge("db.innodb.rows").Set(1)
+	m.MustNewGauge("db.innodb").Set(2)
+	m.MustNewGauge("web.requests").Set(3)
+	v := NewGaugeVec("code")
+	m.Register(v, "web.status")
+	v.With("code", "200").Set(4)
+	v.With("code", "500").Set(5)
+
+	var buf bytes.Buffer
+	if err := m.EncodeJSONWithOptions(&buf, JSONOptions{Nested: true}); err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Db struct {
+			Innodb struct {
+				Self MetricJSON `json:"."`
+				Rows MetricJSON
+			}
+		}
+		Web struct {
+			Requests MetricJSON
+			Status   []MetricJSON
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Db.Innodb.Self.Value != float64(2) || out.Db.Innodb.Rows.Value != float64(1) ||
+		out.Web.Requests.Value != float64(3) || len(out.Web.Status) != 2 {
+		t.Errorf("unexpected tree %s", buf.String())
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	tests := map[string]string{
+		"metrics.json":                     "",
+		"/api/v1/metrics.json/":            "",
+		"/api/v1/metrics.json/db/innodb":   "db.innodb",
+		"/api/v1/metrics.json/db//innodb/": "db.innodb",
+		"/somewhere/else":                  "",
+	}
+	for url, want := range tests {
+		if out := strings.Join(parseURL(url), "."); out != want {
+			t.Errorf("parseURL(%q) = %q, want %q", url, out, want)
+		}
+	}
+}
+
+func TestJsonHandlerQuery(t *testing.T) {
+	m := NewMetricContext("test")
+	m.MustNewGauge("db.rows").Set(1)
+	m.MustNewGauge("db.tmp").Set(2)
+	m.MustNewCounter("db.queries").Add(3)
+	s := m.MustNewStatsTimer("db.latency", time.Millisecond, 10)
+	s.Observe(time.Millisecond)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := httptest.NewRecorder()
+		m.HttpJsonHandler(response, req)
+		return response
+	}
+	names := func(response *httptest.ResponseRecorder) string {
+		var out []MetricJSON
+		if err := json.Unmarshal(response.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		var n []string
+		for _, o := range out {
+			n = append(n, o.Name)
+		}
+		sort.Strings(n)
+		return strings.Join(n, ",")
+	}
+
+	if n := names(get("/metrics.json?type=gauge,counter&exclude=tmp")); n != "db.queries,db.rows" {
+		t.Errorf("type and exclude selected %q, want db.queries,db.rows", n)
+	}
+	if n := names(get("/metrics.json?match=^db\\.(rows|tmp)$")); n != "db.rows,db.tmp" {
+		t.Errorf("match selected %q, want db.rows,db.tmp", n)
+	}
+
+	response := get("/metrics.json?type=statstimer&percentiles=50,99&pretty=1")
+	if !strings.Contains(response.Body.String(), "\n  {") {
+		t.Errorf("pretty output not indented: %s", response.Body.String())
+	}
+	var out []struct {
+		Value struct {
+			Percentiles []percentileJSON
+		}
+	}
+	json.Unmarshal(response.Body.Bytes(), &out)
+	if len(out) != 1 || len(out[0].Value.Percentiles) != 2 ||
+		out[0].Value.Percentiles[1].Percentile != "99.000000" {
+		t.Errorf("percentiles=50,99 returned %s", response.Body.String())
+	}
+
+	for _, url := range []string{"/metrics.json?match=(", "/metrics.json?percentiles=101"} {
+		if code := get(url).Code; code != http.StatusBadRequest {
+			t.Errorf("GET %s = %v, want %v", url, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSortedJSON(t *testing.T) {
+	m := NewMetricContext("test")
+	m.MustNewGauge("b").Set(1)
+	m.MustNewGauge("a").Set(2)
+	m.MustNewCounter("z").Add(3)
+	v := NewGaugeVec("code")
+	v.With("code", "500").Set(4)
+	v.With("code", "200").Set(5)
+	m.Register(v, "ab")
+
+	encode := func() string {
+		var b bytes.Buffer
+		if err := m.EncodeJSONWithOptions(&b, JSONOptions{Sorted: true}); err != nil {
+			t.Fatal(err)
+		}
+		var out []MetricJSON
+		if err := json.Unmarshal(b.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		var n []string
+		for _, o := range out {
+			n = append(n, o.Name+"{"+labelString(o.Labels)+"}")
+		}
+		return strings.Join(n, ",")
+	}
+
+	want := "z{},a{},ab{code=200},ab{code=500},b{}"
+	if n := encode(); n != want {
+		t.Errorf("sorted output = %s, want %s", n, want)
+	}
+	m.MustNewGauge("aa").Set(6)
+	want = "z{},a{},aa{},ab{code=200},ab{code=500},b{}"
+	if n := encode(); n != want {
+		t.Errorf("sorted output after registering aa = %s, want %s", n, want)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestEncodeJSONErrors(t *testing.T) {
+	m := NewMetricContext("test")
+	m.MustNewGauge("unset")
+	m.MustNewGauge("ok").Set(1)
+	m.MustNewGauge("inf").Set(math.Inf(1))
+
+	var buf bytes.Buffer
+	err := m.EncodeJSON(&buf)
+	failed, ok := err.(EncodeError)
+	if !ok || len(failed) != 1 || failed[0].Name != "inf" {
+		t.Fatalf("EncodeJSON error = %v, want EncodeError for inf", err)
+	}
+	var out []MetricJSON
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("output %s is not valid JSON: %v", buf.String(), err)
+	}
+	values := make(map[string]interface{})
+	for _, metric := range out {
+		values[metric.Name] = metric.Value
+	}
+	marker, _ := values["inf"].(map[string]interface{})
+	if len(out) != 2 || values["ok"] != 1.0 || marker["error"] != "json: unsupported value: +Inf" {
+		t.Errorf("output = %s, want ok and an error marker for inf", buf.String())
+	}
+
+	var reported []string
+	o := JSONOptions{Nested: true, OnError: func(e *MetricError) {
+		reported = append(reported, e.Name)
+	}}
+	if err := m.EncodeJSONWithOptions(ioutil.Discard, o); err != nil {
+		t.Errorf("EncodeJSONWithOptions with OnError = %v, want nil", err)
+	}
+	if len(reported) != 1 || reported[0] != "inf" {
+		t.Errorf("OnError reported %v, want [inf]", reported)
+	}
+
+	if err := m.EncodeJSON(failingWriter{}); err == nil || err.Error() != "write failed" {
+		t.Errorf("EncodeJSON to failing writer = %v, want write failed", err)
+	}
+
+	req, err := http.NewRequest("GET", "/metrics.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := httptest.NewRecorder()
+	m.HttpJsonHandler(response, req)
+	if response.Code != http.StatusOK {
+		t.Errorf("status = %v, want %v", response.Code, http.StatusOK)
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &out); err != nil || len(out) != 2 {
+		t.Errorf("body = %s, want inf and ok", response.Body.String())
+	}
+}
+
+func TestSignedAndFloatCountersJSON(t *testing.T) {
+	m := NewMetricContext("test")
+	u := NewUpDownCounter()
+	u.Add(-2)
+	m.Register(u, "inflight")
+	m.MustNewFloatCounter("cpu.seconds").Add(1.5)
+	if _, err := m.NewGauge("inflight"); err == nil {
+		t.Errorf("NewGauge(inflight) succeeded, want type conflict")
+	}
+
+	var buf bytes.Buffer
+	if err := m.EncodeJSONWithOptions(&buf, JSONOptions{Sorted: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"Type":"*metrics.FloatCounter","Name":"cpu.seconds","Value":1.5},` +
+		`{"Type":"*metrics.UpDownCounter","Name":"inflight","Value":-2}]`
+	if buf.String() != want {
+		t.Errorf("EncodeJSON = %s, want %s", buf.String(), want)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Metric is implemented by every type that can be registered with a
+// MetricContext. Encoders use the concrete type of the built-in metrics
+// for format specific output, and Kind and Values for any other type:
+//
+//	JSON:       MarshalJSON
+//	Prometheus: one untyped series per value, named name_key
+//	Influx:     one field per value
+//	Graphite:   one series per value, named name.key
+//	check:      one constant per value, named name_key
+type Metric interface {
+	// Kind returns the lower case name of the metric type, e.g.
+	// counter. It selects the metric in JSONOptions.Types
+	Kind() string
+	// Values returns a snapshot of the values of the metric keyed by
+	// a short lower case name, e.g. value or p99
+	Values() map[string]float64
+	json.Marshaler
+}
+
+// Kind returns "counter"
+func (c *Counter) Kind() string { return "counter" }
+
+// Values returns current, rate, rate1, rate5, rate15 and resets
+func (c *Counter) Values() map[string]float64 {
+	return map[string]float64{
+		"current": float64(c.Get()),
+		"rate":    c.WindowRate(),
+		"rate1":   c.Rate1(),
+		"rate5":   c.Rate5(),
+		"rate15":  c.Rate15(),
+		"resets":  float64(c.Resets()),
+	}
+}
+
+// Kind returns "basiccounter"
+func (c *BasicCounter) Kind() string { return "basiccounter" }
+
+// Values returns value
+func (c *BasicCounter) Values() map[string]float64 {
+	return map[string]float64{"value": float64(c.Get())}
+}
+
+// Kind returns "updowncounter"
+func (c *UpDownCounter) Kind() string { return "updowncounter" }
+
+// Values returns value
+func (c *UpDownCounter) Values() map[string]float64 {
+	return map[string]float64{"value": float64(c.Get())}
+}
+
+// Kind returns "floatcounter"
+func (c *FloatCounter) Kind() string { return "floatcounter" }
+
+// Values returns value
+func (c *FloatCounter) Values() map[string]float64 {
+	return map[string]float64{"value": c.Get()}
+}
+
+// Kind returns "gauge"
+func (g *Gauge) Kind() string { return "gauge" }
+
+// Values returns value
+func (g *Gauge) Values() map[string]float64 {
+	return map[string]float64{"value": g.Get()}
+}
+
+// Kind returns "statstimer"
+func (s *StatsTimer) Kind() string { return "statstimer" }
+
+// Values returns the cumulative count and sum, min, max, mean and
+// stddev of the samples considered, and one value per percentile in
+// PERCENTILES, keyed as by PercentileKey
+func (s *StatsTimer) Values() map[string]float64 {
+	total := s.CumulativeStats()
+	r := map[string]float64{
+		"count": float64(total.Count),
+		"sum":   total.Sum,
+	}
+	if st := s.Stats(); st.Count > 0 {
+		r["min"] = st.Min
+		r["max"] = st.Max
+		r["mean"] = st.Mean
+		r["stddev"] = st.StdDev
+	}
+	if values, ok := s.percentiles(PERCENTILES); ok {
+		for i, p := range PERCENTILES {
+			r[PercentileKey(p)] = values[i]
+		}
+	}
+	return r
+}
+
+// Kind returns "histogram"
+func (h *Histogram) Kind() string { return "histogram" }
+
+// Values returns count, sum and one value per percentile in
+// PERCENTILES, keyed as by PercentileKey
+func (h *Histogram) Values() map[string]float64 {
+	r := map[string]float64{
+		"count": float64(h.Count()),
+		"sum":   h.Sum(),
+	}
+	for _, p := range PERCENTILES {
+		if v, err := h.Percentile(p); err == nil {
+			r[PercentileKey(p)] = v
+		}
+	}
+	return r
+}
+
+// PercentileKey returns the key of percentile p in Values, e.g. p99 or
+// p99_9
+func PercentileKey(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
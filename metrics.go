@@ -3,8 +3,15 @@
 package metrics
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,13 +33,17 @@ func init() {
 
 type OutputFilterFunc func(name string, v interface{}) bool
 
+// MetricContext is a registry of named metrics. Register, Unregister
+// and the snapshot accessors are safe for concurrent use; encoders only
+// ever iterate over snapshots so a scrape never races a registration.
 type MetricContext struct {
-	namespace     string
-	Counters      map[string]*Counter
-	Gauges        map[string]*Gauge
-	BasicCounters map[string]*BasicCounter
-	StatsTimers   map[string]*StatsTimer
-	OutputFilter  OutputFilterFunc
+	namespace    string
+	metrics      map[string]Metric
+	vecs         map[string]vector
+	collectors   map[string]Collector
+	sorted       []jsonEntry // cached by sortedEntries, reset on change
+	mu           sync.RWMutex
+	OutputFilter OutputFilterFunc
 }
 
 // Creates a new metric context. A metric context specifies a namespace
@@ -49,10 +60,9 @@ const NS_IN_SEC = float64(time.Second)
 func NewMetricContext(namespace string) *MetricContext {
 	m := new(MetricContext)
 	m.namespace = namespace
-	m.Counters = make(map[string]*Counter, 0)
-	m.Gauges = make(map[string]*Gauge, 0)
-	m.BasicCounters = make(map[string]*BasicCounter, 0)
-	m.StatsTimers = make(map[string]*StatsTimer, 0)
+	m.metrics = make(map[string]Metric, 0)
+	m.vecs = make(map[string]vector, 0)
+	m.collectors = make(map[string]Collector, 0)
 	m.OutputFilter = func(name string, v interface{}) bool {
 		return true
 	}
@@ -60,50 +70,463 @@ func NewMetricContext(namespace string) *MetricContext {
 	return m
 }
 
+// Namespace returns the namespace all metrics in this context belong to
+func (m *MetricContext) Namespace() string {
+	return m.namespace
+}
+
 // Register(v Metric) registers a metric with metric
-// context
-func (m *MetricContext) Register(v interface{}, name string) {
+// context. v must be a Metric or a metric vector; anything else is
+// rejected with an error. A metric registered under name before is
+// replaced
+func (m *MetricContext) Register(v interface{}, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	switch v := v.(type) {
-	case *BasicCounter:
-		m.BasicCounters[name] = v
-	case *Counter:
-		m.Counters[name] = v
-	case *Gauge:
-		m.Gauges[name] = v
-	case *StatsTimer:
-		m.StatsTimers[name] = v
+	case vector:
+		delete(m.metrics, name)
+		m.vecs[name] = v
+	case Metric:
+		delete(m.vecs, name)
+		m.metrics[name] = v
+	default:
+		return fmt.Errorf("metrics: cannot register %q: %T is not a Metric", name, v)
 	}
+	m.sorted = nil
+	return nil
 }
 
 // Unregister(v Metric) unregisters a metric with metric
-// context
+// context. Nothing is removed if name is registered with a metric of
+// a different type than v
 func (m *MetricContext) Unregister(v interface{}, name string) {
-	switch v.(type) {
-	case *BasicCounter:
-		delete(m.BasicCounters, name)
-	case *Counter:
-		delete(m.Counters, name)
-	case *Gauge:
-		delete(m.Gauges, name)
-	case *StatsTimer:
-		delete(m.StatsTimers, name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r := m.lookup(name); r != nil && reflect.TypeOf(r) == reflect.TypeOf(v) {
+		delete(m.metrics, name)
+		delete(m.vecs, name)
+		m.sorted = nil
+	}
+}
+
+// NewCounter returns the counter registered under name, creating and
+// registering a new one if the name is free. An error is returned if
+// name is already registered as a different metric type
+func (m *MetricContext) NewCounter(name string) (*Counter, error) {
+	v := m.getOrRegister(name, func() Metric { return NewCounter() })
+	c, ok := v.(*Counter)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return c, nil
+}
+
+// MustNewCounter is like NewCounter but panics on a type conflict
+func (m *MetricContext) MustNewCounter(name string) *Counter {
+	c, err := m.NewCounter(name)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// NewBasicCounter returns the basic counter registered under name,
+// creating and registering a new one if the name is free
+func (m *MetricContext) NewBasicCounter(name string) (*BasicCounter, error) {
+	v := m.getOrRegister(name, func() Metric { return NewBasicCounter() })
+	c, ok := v.(*BasicCounter)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return c, nil
+}
+
+// MustNewBasicCounter is like NewBasicCounter but panics on a type conflict
+func (m *MetricContext) MustNewBasicCounter(name string) *BasicCounter {
+	c, err := m.NewBasicCounter(name)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// NewGauge returns the gauge registered under name, creating and
+// registering a new one if the name is free
+func (m *MetricContext) NewGauge(name string) (*Gauge, error) {
+	v := m.getOrRegister(name, func() Metric { return NewGauge() })
+	g, ok := v.(*Gauge)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return g, nil
+}
+
+// MustNewGauge is like NewGauge but panics on a type conflict
+func (m *MetricContext) MustNewGauge(name string) *Gauge {
+	g, err := m.NewGauge(name)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// NewStatsTimer returns the stats timer registered under name, creating
+// and registering a new one if the name is free. timeUnit and nsamples
+// are only used when a new timer is created
+func (m *MetricContext) NewStatsTimer(name string, timeUnit time.Duration, nsamples int) (*StatsTimer, error) {
+	v := m.getOrRegister(name, func() Metric { return NewStatsTimer(timeUnit, nsamples) })
+	s, ok := v.(*StatsTimer)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return s, nil
+}
+
+// MustNewStatsTimer is like NewStatsTimer but panics on a type conflict
+func (m *MetricContext) MustNewStatsTimer(name string, timeUnit time.Duration, nsamples int) *StatsTimer {
+	s, err := m.NewStatsTimer(name, timeUnit, nsamples)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewHistogram returns the histogram registered under name, creating
+// and registering a new one if the name is free. timeUnit and buckets
+// are only used when a new histogram is created
+func (m *MetricContext) NewHistogram(name string, timeUnit time.Duration, buckets []float64) (*Histogram, error) {
+	v := m.getOrRegister(name, func() Metric { return NewHistogram(timeUnit, buckets) })
+	h, ok := v.(*Histogram)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return h, nil
+}
+
+// MustNewHistogram is like NewHistogram but panics on a type conflict
+func (m *MetricContext) MustNewHistogram(name string, timeUnit time.Duration, buckets []float64) *Histogram {
+	h, err := m.NewHistogram(name, timeUnit, buckets)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// NewUpDownCounter returns the up/down counter registered under name,
+// creating and registering a new one if the name is free
+func (m *MetricContext) NewUpDownCounter(name string) (*UpDownCounter, error) {
+	v := m.getOrRegister(name, func() Metric { return NewUpDownCounter() })
+	c, ok := v.(*UpDownCounter)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return c, nil
+}
+
+// MustNewUpDownCounter is like NewUpDownCounter but panics on a type
+// conflict
+func (m *MetricContext) MustNewUpDownCounter(name string) *UpDownCounter {
+	c, err := m.NewUpDownCounter(name)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// NewFloatCounter returns the float counter registered under name,
+// creating and registering a new one if the name is free
+func (m *MetricContext) NewFloatCounter(name string) (*FloatCounter, error) {
+	v := m.getOrRegister(name, func() Metric { return NewFloatCounter() })
+	c, ok := v.(*FloatCounter)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return c, nil
+}
+
+// MustNewFloatCounter is like NewFloatCounter but panics on a type
+// conflict
+func (m *MetricContext) MustNewFloatCounter(name string) *FloatCounter {
+	c, err := m.NewFloatCounter(name)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// NewGaugeFunc returns the gauge func registered under name, creating
+// and registering a new one calling f if the name is free
+func (m *MetricContext) NewGaugeFunc(name string, f func() float64) (*GaugeFunc, error) {
+	v := m.getOrRegister(name, func() Metric { return NewGaugeFunc(f) })
+	g, ok := v.(*GaugeFunc)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return g, nil
+}
+
+// MustNewGaugeFunc is like NewGaugeFunc but panics on a type conflict
+func (m *MetricContext) MustNewGaugeFunc(name string, f func() float64) *GaugeFunc {
+	g, err := m.NewGaugeFunc(name, f)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// NewCounterFunc returns the counter func registered under name,
+// creating and registering a new one calling f if the name is free
+func (m *MetricContext) NewCounterFunc(name string, f func() uint64) (*CounterFunc, error) {
+	v := m.getOrRegister(name, func() Metric { return NewCounterFunc(f) })
+	c, ok := v.(*CounterFunc)
+	if !ok {
+		return nil, typeConflict(name, v)
+	}
+	return c, nil
+}
+
+// MustNewCounterFunc is like NewCounterFunc but panics on a type
+// conflict
+func (m *MetricContext) MustNewCounterFunc(name string, f func() uint64) *CounterFunc {
+	c, err := m.NewCounterFunc(name, f)
+	if err != nil {
+		panic(err)
 	}
+	return c
 }
 
-// HttpJsonHandler setups a handler for exposing metrics via JSON over HTTP
+// Metrics returns a snapshot of all registered metrics except metric
+// vectors, whose children are returned by LabeledMetrics. The returned
+// map is a copy and may be ranged over without holding any lock
+func (m *MetricContext) Metrics() map[string]Metric {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := make(map[string]Metric, len(m.metrics))
+	for name, v := range m.metrics {
+		r[name] = v
+	}
+	return r
+}
+
+// Counters returns a snapshot of the registered counters
+func (m *MetricContext) Counters() map[string]*Counter {
+	r := make(map[string]*Counter)
+	for name, v := range m.Metrics() {
+		if c, ok := v.(*Counter); ok {
+			r[name] = c
+		}
+	}
+	return r
+}
+
+// BasicCounters returns a snapshot of the registered basic counters
+func (m *MetricContext) BasicCounters() map[string]*BasicCounter {
+	r := make(map[string]*BasicCounter)
+	for name, v := range m.Metrics() {
+		if c, ok := v.(*BasicCounter); ok {
+			r[name] = c
+		}
+	}
+	return r
+}
+
+// Gauges returns a snapshot of the registered gauges
+func (m *MetricContext) Gauges() map[string]*Gauge {
+	r := make(map[string]*Gauge)
+	for name, v := range m.Metrics() {
+		if g, ok := v.(*Gauge); ok {
+			r[name] = g
+		}
+	}
+	return r
+}
+
+// StatsTimers returns a snapshot of the registered stats timers
+func (m *MetricContext) StatsTimers() map[string]*StatsTimer {
+	r := make(map[string]*StatsTimer)
+	for name, v := range m.Metrics() {
+		if s, ok := v.(*StatsTimer); ok {
+			r[name] = s
+		}
+	}
+	return r
+}
+
+// HttpJsonHandler setups a handler for exposing metrics via JSON over HTTP.
+// Path components after metrics.json select the metrics under that
+// dotted prefix, e.g. /metrics.json/db/innodb only returns metrics named
+// db.innodb.*. Supported query parameters, see JSONOptions:
+//
+//	nested=1           - render a tree of JSON objects keyed by name components
+//	type=counter,gauge - only return metrics of these types
+//	match=<regex>      - only return metrics whose name matches
+//	exclude=<regex>    - leave out metrics whose name matches
+//	pretty=1           - indent the output, sorted
+//	sorted=1           - order metrics by type, then name
+//	percentiles=50,99  - percentiles to report for timers and histograms
+//
+// Invalid parameters are answered with 400 Bad Request. Metrics that
+// fail to marshal are written with {"error": "..."} as their value,
+// along with all other metrics. Any other failure is answered with 500
+// Internal Server Error and a JSON object holding the error
 func (m *MetricContext) HttpJsonHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		return
 	}
+	o, err := parseJSONOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = m.EncodeJSONWithOptions(&buf, o)
 	w.Header().Set("Content-Type", "application/json")
-	m.EncodeJSON(w)
+	if _, ok := err.(EncodeError); err != nil && !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errorJSON(err))
+		return
+	}
+	buf.WriteTo(w)
 	w.Write([]byte("\n")) // Be nice to curl
 }
 
+// Histograms returns a snapshot of the registered histograms
+func (m *MetricContext) Histograms() map[string]*Histogram {
+	r := make(map[string]*Histogram)
+	for name, v := range m.Metrics() {
+		if h, ok := v.(*Histogram); ok {
+			r[name] = h
+		}
+	}
+	return r
+}
+
+// UpDownCounters returns a snapshot of the registered up/down counters
+func (m *MetricContext) UpDownCounters() map[string]*UpDownCounter {
+	r := make(map[string]*UpDownCounter)
+	for name, v := range m.Metrics() {
+		if c, ok := v.(*UpDownCounter); ok {
+			r[name] = c
+		}
+	}
+	return r
+}
+
+// FloatCounters returns a snapshot of the registered float counters
+func (m *MetricContext) FloatCounters() map[string]*FloatCounter {
+	r := make(map[string]*FloatCounter)
+	for name, v := range m.Metrics() {
+		if c, ok := v.(*FloatCounter); ok {
+			r[name] = c
+		}
+	}
+	return r
+}
+
 // unexported functions
+
+// lookup returns the metric or vector registered under name, or nil.
+// Callers must hold m.mu
+func (m *MetricContext) lookup(name string) interface{} {
+	if v, ok := m.metrics[name]; ok {
+		return v
+	}
+	if v, ok := m.vecs[name]; ok {
+		return v
+	}
+	return nil
+}
+
+// getOrRegister returns whatever is registered under name, registering
+// the metric returned by create if the name is free
+func (m *MetricContext) getOrRegister(name string, create func() Metric) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v := m.lookup(name); v != nil {
+		return v
+	}
+	v := create()
+	m.metrics[name] = v
+	m.sorted = nil
+	return v
+}
+
+func typeConflict(name string, v interface{}) error {
+	return fmt.Errorf("metrics: %q is already registered as %T", name, v)
+}
+
+// parseJSONOptions builds JSONOptions from the path and the parsed
+// form of r
+func parseJSONOptions(r *http.Request) (JSONOptions, error) {
+	var o JSONOptions
+	var err error
+	o.Prefix = strings.Join(parseURL(r.URL.Path), ".")
+	o.Nested, _ = strconv.ParseBool(r.Form.Get("nested"))
+	o.Pretty, _ = strconv.ParseBool(r.Form.Get("pretty"))
+	o.Sorted, _ = strconv.ParseBool(r.Form.Get("sorted"))
+	for _, types := range r.Form["type"] {
+		o.Types = append(o.Types, strings.Split(types, ",")...)
+	}
+	if match := r.Form.Get("match"); match != "" {
+		if o.Match, err = regexp.Compile(match); err != nil {
+			return o, err
+		}
+	}
+	if exclude := r.Form.Get("exclude"); exclude != "" {
+		if o.Exclude, err = regexp.Compile(exclude); err != nil {
+			return o, err
+		}
+	}
+	if ps := r.Form.Get("percentiles"); ps != "" {
+		for _, p := range strings.Split(ps, ",") {
+			f, err := strconv.ParseFloat(p, 64)
+			if err != nil || f < 0 || f > 100 {
+				return o, fmt.Errorf("invalid percentile %q", p)
+			}
+			o.Percentiles = append(o.Percentiles, f)
+		}
+	}
+	return o, nil
+}
+
+// parseURL returns the non-empty path components following
+// metrics.json in url
 func parseURL(url string) []string {
-	path := strings.SplitN(url, "metrics.json", 2)[1]
-	levels := strings.Split(path, "/")
-	return levels[1:]
+	parts := strings.SplitN(url, "metrics.json", 2)
+	if len(parts) < 2 {
+		return nil
+	}
+	var levels []string
+	for _, level := range strings.Split(parts[1], "/") {
+		if level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// errorJSON is the body of a failed HttpJsonHandler response
+func errorJSON(err error) interface{} {
+	type failedJSON struct {
+		Name   string
+		Labels map[string]string `json:",omitempty"`
+		Error  string
+	}
+	var out struct {
+		Error  string
+		Failed []failedJSON `json:",omitempty"`
+	}
+	out.Error = err.Error()
+	if failed, ok := err.(EncodeError); ok {
+		for _, e := range failed {
+			out.Failed = append(out.Failed, failedJSON{e.Name, e.Labels, e.Err.Error()})
+		}
+	}
+	return out
 }
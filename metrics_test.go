@@ -6,6 +6,10 @@ import "testing"
 import "time"
 import "math"
 import "sync"
+import "io/ioutil"
+import "encoding/json"
+import "bytes"
+import "strings"
 
 // BUG: This test will most likely fail on a highly loaded
 // system
@@ -120,3 +124,342 @@ func TestStatsTimer(t *testing.T) {
 		t.Errorf("Percentile expected: 750 got: %v", pctile)
 	}
 }
+
+func TestConcurrentRegisterEncode(t *testing.T) {
+	m := NewMetricContext("test")
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c := NewCounter()
+				m.Register(c, "counter")
+				m.Unregister(c, "counter")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.EncodeJSON(ioutil.Discard)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestGetOrCreate(t *testing.T) {
+	m := NewMetricContext("test")
+	c1, err := m.NewCounter("requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := m.NewCounter("requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Errorf("m.NewCounter() returned a new counter for a registered name")
+	}
+
+	if _, err := m.NewGauge("requests"); err == nil {
+		t.Errorf("m.NewGauge() on a counter name, want error")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("m.MustNewStatsTimer() on a counter name, want panic")
+		}
+	}()
+	m.MustNewStatsTimer("requests", time.Millisecond, 10)
+}
+
+func TestWindowedStatsTimer(t *testing.T) {
+	s := NewWindowedStatsTimer(time.Millisecond, time.Minute, 600)
+	w := s.store.(*windowStore)
+	now := int64(0)
+	w.now = func() int64 { return now }
+
+	// an incident long ago
+	s.ObserveValue(int64(time.Second))
+	now += int64(30 * time.Second)
+	for i := 1; i <= 10; i++ {
+		s.ObserveValue(int64(i) * int64(time.Millisecond))
+	}
+
+	pctile, err := s.Percentile(100)
+	if pctile != 1000 || err != nil {
+		t.Errorf("s.Percentile(100) = %v, want %v", pctile, 1000)
+	}
+
+	// the incident has left the window
+	now += int64(40 * time.Second)
+	pctile, err = s.Percentile(100)
+	if pctile != 10 || err != nil {
+		t.Errorf("s.Percentile(100) = %v, want %v", pctile, 10)
+	}
+
+	now += int64(time.Minute)
+	if _, err = s.Percentile(50); err == nil {
+		t.Errorf("s.Percentile(50) on expired window, want error")
+	}
+}
+
+func TestStatsTimerStats(t *testing.T) {
+	s := NewStatsTimer(time.Millisecond, 4)
+	for _, v := range []int64{2, 4, 4, 4, 5, 5, 7, 9} {
+		s.ObserveValue(v * int64(time.Millisecond))
+	}
+
+	total := s.CumulativeStats()
+	want := Stats{Count: 8, Sum: 40, Min: 2, Max: 9, Mean: 5, StdDev: 2}
+	if math.Abs(total.StdDev-want.StdDev) > 1e-9 {
+		t.Errorf("s.CumulativeStats().StdDev = %v, want %v", total.StdDev, want.StdDev)
+	}
+	total.StdDev = want.StdDev
+	if total != want {
+		t.Errorf("s.CumulativeStats() = %+v, want %+v", total, want)
+	}
+
+	// only the last 4 samples are retained
+	window := s.Stats()
+	if window.Count != 4 || window.Min != 5 || window.Max != 9 || window.Mean != 6.5 {
+		t.Errorf("s.Stats() = %+v, want count 4, min 5, max 9, mean 6.5", window)
+	}
+
+	s.Reset()
+	if s.Count() != 0 || s.Stats() != (Stats{}) {
+		t.Errorf("stats not cleared by s.Reset()")
+	}
+}
+
+func TestStatsTimerObserve(t *testing.T) {
+	s := NewStatsTimer(time.Millisecond, 10)
+	s.Observe(3 * time.Millisecond)
+	s.ObserveValue(int64(5 * time.Millisecond))
+	s.ObserveValue(-1)
+	s.Time(func() {
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	if s.Count() != 4 {
+		t.Errorf("s.Count() = %v, want %v", s.Count(), 4)
+	}
+	if min := s.Stats().Min; min != 0 {
+		t.Errorf("s.Stats().Min = %v, want %v", min, 0)
+	}
+	if max := s.Stats().Max; max < 10 {
+		t.Errorf("s.Stats().Max = %v, want >= %v", max, 10)
+	}
+}
+
+func TestStatsTimerSamplesSince(t *testing.T) {
+	s := NewStatsTimer(time.Millisecond, 3)
+	s.Observe(time.Millisecond)
+	s.Observe(2 * time.Millisecond)
+
+	samples, total := s.SamplesSince(0)
+	if len(samples) != 2 || samples[0] != 1 || samples[1] != 2 || total.Count != 2 {
+		t.Errorf("s.SamplesSince(0) = %v, %+v, want [1 2]", samples, total)
+	}
+
+	for i := 3; i <= 6; i++ {
+		s.Observe(time.Duration(i) * time.Millisecond)
+	}
+	// sample 3 has already been evicted from the ring
+	samples, total = s.SamplesSince(total.Count)
+	if len(samples) != 3 || samples[0] != 4 || samples[2] != 6 || total.Count != 6 {
+		t.Errorf("s.SamplesSince(2) = %v, %+v, want [4 5 6]", samples, total)
+	}
+}
+
+func TestCounterZeroValue(t *testing.T) {
+	var c Counter
+	c.Add(1)
+	c.Set(3)
+	if v := c.Get(); v != 3 {
+		t.Errorf("c.Get() = %v, want %v", v, 3)
+	}
+	if r := c.WindowRate(); r != 0 {
+		t.Errorf("c.WindowRate() = %v, want %v", r, 0)
+	}
+	if _, err := c.MarshalJSON(); err != nil {
+		t.Errorf("c.MarshalJSON() = %v", err)
+	}
+}
+
+func TestCounterMovingRates(t *testing.T) {
+	var now int64
+	c := NewCounter()
+	c.now = func() int64 { return now }
+	c.Reset()
+
+	interval := int64(RATE_INTERVAL)
+	// 10/sec for one minute
+	for i := 0; i < 12; i++ {
+		c.Add(uint64(10 * RATE_INTERVAL.Seconds()))
+		now += interval
+	}
+	if r := c.WindowRate(); r != 10 {
+		t.Errorf("c.WindowRate() = %v, want %v", r, 10)
+	}
+	// a second reader does not change what the first sees
+	r1 := c.Rate1()
+	if r := c.Rate1(); r != r1 || math.Abs(r-10) > 1e-9 {
+		t.Errorf("c.Rate1() = %v, then %v, want %v", r1, r, 10)
+	}
+
+	// idle for one minute
+	now += 12 * interval
+	if r := c.WindowRate(); r != 0 {
+		t.Errorf("idle c.WindowRate() = %v, want %v", r, 0)
+	}
+	want := 10 * math.Exp(-1)
+	if r := c.Rate1(); math.Abs(r-want) > 1e-9 {
+		t.Errorf("idle c.Rate1() = %v, want %v", r, want)
+	}
+	if r5, r15 := c.Rate5(), c.Rate15(); !(r5 > c.Rate1() && r15 > r5) {
+		t.Errorf("Rate5() = %v, Rate15() = %v, want slower decay than Rate1()", r5, r15)
+	}
+}
+
+func TestCounterReset(t *testing.T) {
+	now := int64(time.Second)
+	c := NewCounter()
+	c.now = func() int64 { return now }
+	c.Reset()
+
+	c.Set(1000)
+	now += int64(time.Second)
+	c.Set(1100)
+	if r := c.ComputeRate(); math.Abs(r-100) > 1e-9 {
+		t.Errorf("c.ComputeRate() = %v, want %v", r, 100)
+	}
+
+	// source restarted
+	now += int64(time.Second)
+	c.Set(10)
+	now += int64(time.Second)
+	c.Set(60)
+	if r := c.ComputeRate(); math.Abs(r-50) > 1e-9 {
+		t.Errorf("c.ComputeRate() after reset = %v, want %v", r, 50)
+	}
+	if n := c.Resets(); n != 1 {
+		t.Errorf("c.Resets() = %v, want %v", n, 1)
+	}
+	if c.LastReset().IsZero() {
+		t.Errorf("c.LastReset() is zero after a reset")
+	}
+
+	// wraparound of a 32 bit counter
+	c.SetMaxValue(math.MaxUint32)
+	now += int64(time.Second)
+	c.Set(math.MaxUint32 - 9)
+	c.ComputeRate()
+	now += int64(time.Second)
+	c.Set(20)
+	if r := c.ComputeRate(); math.Abs(r-30) > 1e-9 {
+		t.Errorf("c.ComputeRate() after wraparound = %v, want %v", r, 30)
+	}
+
+	var out struct{ Resets uint64 }
+	b, _ := c.MarshalJSON()
+	if err := json.Unmarshal(b, &out); err != nil || out.Resets != 2 {
+		t.Errorf("c.MarshalJSON() = %s, want resets 2", b)
+	}
+}
+
+func TestUpDownCounter(t *testing.T) {
+	c := NewUpDownCounter()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Inc()
+			c.Add(-3)
+		}()
+	}
+	wg.Wait()
+	if c.Get() != -200 {
+		t.Errorf("c.Get() = %v, want %v", c.Get(), -200)
+	}
+	c.Dec()
+	if b, _ := c.MarshalJSON(); string(b) != "-201" {
+		t.Errorf("c.MarshalJSON() = %s, want %v", b, -201)
+	}
+}
+
+func TestFloatCounter(t *testing.T) {
+	c := NewFloatCounter()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Add(0.5)
+		}()
+	}
+	wg.Wait()
+	c.Add(-1)
+	c.Add(math.NaN())
+	if c.Get() != 50 {
+		t.Errorf("c.Get() = %v, want %v", c.Get(), 50)
+	}
+}
+
+// queueMetric is a custom Metric
+type queueMetric struct {
+	depth, capacity float64
+}
+
+func (q *queueMetric) Kind() string { return "queue" }
+
+func (q *queueMetric) Values() map[string]float64 {
+	return map[string]float64{"depth": q.depth, "capacity": q.capacity}
+}
+
+func (q *queueMetric) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.Values())
+}
+
+func TestRegisterMetric(t *testing.T) {
+	m := NewMetricContext("test")
+	if err := m.Register(42, "answer"); err == nil {
+		t.Errorf("Register(42) succeeded, want an error")
+	}
+	if err := m.Register(&queueMetric{3, 10}, "jobs"); err != nil {
+		t.Fatalf("Register(queueMetric) = %v", err)
+	}
+	if _, err := m.NewCounter("jobs"); err == nil {
+		t.Errorf("NewCounter(jobs) succeeded, want type conflict")
+	}
+
+	var buf bytes.Buffer
+	if err := m.EncodeJSONWithOptions(&buf, JSONOptions{Types: []string{"queue"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"Type":"*metrics.queueMetric","Name":"jobs","Value":{"capacity":10,"depth":3}}]`
+	if buf.String() != want {
+		t.Errorf("EncodeJSON = %s, want %s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := m.EncodePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "# TYPE test_jobs_depth untyped\ntest_jobs_depth 3\n") {
+		t.Errorf("EncodePrometheus = %s, want untyped test_jobs_depth", buf.String())
+	}
+
+	m.Unregister(NewGauge(), "jobs")
+	if len(m.Metrics()) != 1 {
+		t.Errorf("Unregister with a Gauge removed the queue metric")
+	}
+	m.Unregister(&queueMetric{}, "jobs")
+	if len(m.Metrics()) != 0 {
+		t.Errorf("Metrics() = %v after Unregister, want none", m.Metrics())
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package otlp periodically exports the metrics of a MetricContext to an
+// OpenTelemetry collector using OTLP/HTTP with the JSON encoding.
+//
+// Counters, BasicCounters, FloatCounters and CounterFuncs are
+// exported as monotonic cumulative Sums, UpDownCounters as
+// non-monotonic Sums, Gauges as Gauges, StatsTimers as Summaries
+// (cumulative count and sum, quantiles over the samples the timer
+// currently considers) and Histograms as cumulative explicit bucket
+// Histograms. Labels of vector children become data point attributes.
+// Metrics of other kinds are exported as Gauges with one data point
+// per value, see metrics.Metric, carrying the value's key in a key
+// attribute. The context namespace is exported as the service.name
+// resource attribute.
+//
+// Usage:
+//
+//	m := metrics.NewMetricContext("webapp")
+//	e := otlp.New(m, "http://localhost:4318/v1/metrics")
+//	e.Start()
+//	defer e.Stop()
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+// default export interval
+const INTERVAL = time.Minute
+
+// default HTTP timeout
+const TIMEOUT = 10 * time.Second
+
+// instrumentation scope reported for all metrics
+const SCOPE = "github.com/measure/metrics"
+
+// aggregation temporality, see opentelemetry/proto/metrics/v1
+const temporalityCumulative = 2
+
+type Exporter struct {
+	// Interval is the time between two exports
+	Interval time.Duration
+	// Client is used for all requests
+	Client *http.Client
+	// Headers are added to every request, e.g. for authentication
+	Headers map[string]string
+	// ResourceAttributes are added to, and override, the resource
+	// attributes derived from the context
+	ResourceAttributes map[string]string
+	// ErrorHandler is called with errors of exports run by Start.
+	// Errors are discarded if it is nil
+	ErrorHandler func(error)
+
+	m        *metrics.MetricContext
+	endpoint string
+	start    int64
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// New creates an Exporter posting the metrics of m to the OTLP/HTTP
+// metrics endpoint, e.g. http://localhost:4318/v1/metrics
+func New(m *metrics.MetricContext, endpoint string) *Exporter {
+	e := &Exporter{
+		Interval: INTERVAL,
+		Client:   &http.Client{Timeout: TIMEOUT},
+		m:        m,
+		endpoint: endpoint,
+		start:    time.Now().UnixNano(),
+	}
+	return e
+}
+
+// Start exports metrics every Interval in a new goroutine until Stop
+// is called
+func (e *Exporter) Start() {
+	e.quit = make(chan struct{})
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := e.Export(); err != nil && e.ErrorHandler != nil {
+					e.ErrorHandler(err)
+				}
+			case <-e.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the export goroutine and exports one last time. It
+// returns the error of the final export
+func (e *Exporter) Stop() error {
+	if e.quit != nil {
+		close(e.quit)
+		<-e.done
+	}
+	return e.Export()
+}
+
+// Export posts all metrics passing the context's OutputFilter to the
+// collector. A labeled metric whose kind differs from the first metric
+// of the same name is left out and reported in the returned error once
+// the others were posted
+func (e *Exporter) Export() error {
+	r, rerr := e.request(time.Now().UnixNano())
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: %s: %s", resp.Status, body)
+	}
+	return rerr
+}
+
+// OTLP JSON types, see opentelemetry/proto/collector/metrics/v1.
+// 64 bit integers are encoded as strings, per the protobuf JSON mapping
+
+type exportRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeMetrics struct {
+	Scope   scope    `json:"scope"`
+	Metrics []metric `json:"metrics"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type metric struct {
+	Name      string     `json:"name"`
+	Sum       *sum       `json:"sum,omitempty"`
+	Gauge     *gauge     `json:"gauge,omitempty"`
+	Summary   *summary   `json:"summary,omitempty"`
+	Histogram *histogram `json:"histogram,omitempty"`
+}
+
+type sum struct {
+	DataPoints             []numberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type gauge struct {
+	DataPoints []numberDataPoint `json:"dataPoints"`
+}
+
+type numberDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsInt             string     `json:"asInt,omitempty"`
+	AsDouble          *float64   `json:"asDouble,omitempty"`
+}
+
+type summary struct {
+	DataPoints []summaryDataPoint `json:"dataPoints"`
+}
+
+type summaryDataPoint struct {
+	Attributes        []keyValue      `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	QuantileValues    []quantileValue `json:"quantileValues,omitempty"`
+}
+
+type quantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type histogram struct {
+	DataPoints             []histogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type histogramDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	Count             string     `json:"count"`
+	Sum               float64    `json:"sum"`
+	BucketCounts      []string   `json:"bucketCounts"`
+	ExplicitBounds    []float64  `json:"explicitBounds"`
+}
+
+// unexported functions
+
+// request converts the context to an export request. Children of the
+// same vector share a single metric with one data point each. Labeled
+// metrics that cannot share the metric of their name are left out and
+// named in the returned error
+func (e *Exporter) request(now int64) (*exportRequest, error) {
+	var out []metric
+	index := make(map[string]int)
+	var conflicts []string
+	add := func(name string, labels map[string]string, v metrics.Metric) {
+		if !e.m.OutputFilter(name, v) {
+			return
+		}
+		m, ok := e.convert(name, attributes(labels), v, now)
+		if !ok {
+			return
+		}
+		i, seen := index[name]
+		if !seen || labels == nil {
+			index[name] = len(out)
+			out = append(out, m)
+			return
+		}
+		// another child of a vector already converted
+		if !sameKind(out[i], m) {
+			if len(conflicts) == 0 || conflicts[len(conflicts)-1] != name {
+				conflicts = append(conflicts, name)
+			}
+			return
+		}
+		switch {
+		case m.Sum != nil:
+			out[i].Sum.DataPoints = append(out[i].Sum.DataPoints, m.Sum.DataPoints...)
+		case m.Gauge != nil:
+			out[i].Gauge.DataPoints = append(out[i].Gauge.DataPoints, m.Gauge.DataPoints...)
+		case m.Summary != nil:
+			out[i].Summary.DataPoints = append(out[i].Summary.DataPoints, m.Summary.DataPoints...)
+		case m.Histogram != nil:
+			out[i].Histogram.DataPoints = append(out[i].Histogram.DataPoints, m.Histogram.DataPoints...)
+		}
+	}
+
+	for name, v := range e.m.Metrics() {
+		add(name, nil, v)
+	}
+	for _, l := range append(e.m.LabeledMetrics(), e.m.Collect()...) {
+		add(l.Name, l.Labels, l.Metric)
+	}
+
+	attrs := map[string]string{}
+	if ns := e.m.Namespace(); ns != "" {
+		attrs["service.name"] = ns
+	}
+	for k, v := range e.ResourceAttributes {
+		attrs[k] = v
+	}
+
+	r := &exportRequest{[]resourceMetrics{{
+		Resource:     resource{attributes(attrs)},
+		ScopeMetrics: []scopeMetrics{{scope{SCOPE}, out}},
+	}}}
+	if len(conflicts) > 0 {
+		return r, fmt.Errorf("otlp: left out metrics of a different kind than others named %s",
+			strings.Join(conflicts, ", "))
+	}
+	return r, nil
+}
+
+// sameKind reports whether the data points of b can be added to a
+func sameKind(a, b metric) bool {
+	switch {
+	case a.Sum != nil:
+		return b.Sum != nil && a.Sum.IsMonotonic == b.Sum.IsMonotonic
+	case a.Gauge != nil:
+		return b.Gauge != nil
+	case a.Summary != nil:
+		return b.Summary != nil
+	case a.Histogram != nil:
+		return b.Histogram != nil
+	}
+	return false
+}
+
+func (e *Exporter) convert(name string, attrs []keyValue, v metrics.Metric, now int64) (metric, bool) {
+	start := nanos(e.start)
+	ts := nanos(now)
+	m := metric{Name: name}
+
+	switch v := v.(type) {
+	case *metrics.Counter:
+		m.Sum = &sum{[]numberDataPoint{{attrs, start, ts,
+			strconv.FormatUint(v.Get(), 10), nil}}, temporalityCumulative, true}
+	case *metrics.BasicCounter:
+		m.Sum = &sum{[]numberDataPoint{{attrs, start, ts,
+			strconv.FormatUint(v.Get(), 10), nil}}, temporalityCumulative, true}
+	case *metrics.CounterFunc:
+		// a failed callback leaves the metric out
+		c, err := v.Get()
+		if err != nil {
+			return m, false
+		}
+		m.Sum = &sum{[]numberDataPoint{{attrs, start, ts,
+			strconv.FormatUint(c, 10), nil}}, temporalityCumulative, true}
+	case *metrics.UpDownCounter:
+		m.Sum = &sum{[]numberDataPoint{{attrs, start, ts,
+			strconv.FormatInt(v.Get(), 10), nil}}, temporalityCumulative, false}
+	case *metrics.FloatCounter:
+		f := v.Get()
+		m.Sum = &sum{[]numberDataPoint{{attrs, start, ts, "", &f}},
+			temporalityCumulative, true}
+	case *metrics.Gauge:
+		g := v.Get()
+		if math.IsNaN(g) || math.IsInf(g, 0) {
+			return m, false
+		}
+		m.Gauge = &gauge{[]numberDataPoint{{attrs, "", ts, "", &g}}}
+	case *metrics.StatsTimer:
+		total := v.CumulativeStats()
+		var quantiles []quantileValue
+		for _, p := range metrics.PERCENTILES {
+			if q, err := v.Percentile(p); err == nil {
+				quantiles = append(quantiles, quantileValue{p / 100, q})
+			}
+		}
+		m.Summary = &summary{[]summaryDataPoint{{attrs, start, ts,
+			strconv.FormatUint(total.Count, 10), total.Sum, quantiles}}}
+	case *metrics.Histogram:
+		bounds, counts := v.Buckets()
+		bucketCounts := make([]string, len(counts))
+		var count uint64
+		for i, c := range counts {
+			bucketCounts[i] = strconv.FormatUint(c, 10)
+			count += c
+		}
+		m.Histogram = &histogram{[]histogramDataPoint{{attrs, start, ts,
+			strconv.FormatUint(count, 10), v.Sum(), bucketCounts, bounds}},
+			temporalityCumulative}
+	default:
+		// one gauge data point per value, told apart by a key attribute
+		values := v.Values()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var points []numberDataPoint
+		for _, k := range keys {
+			f := values[k]
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				continue
+			}
+			pointAttrs := attrs
+			if len(keys) > 1 || k != "value" {
+				pointAttrs = append(append([]keyValue(nil), attrs...), keyValue{"key", anyValue{k}})
+			}
+			points = append(points, numberDataPoint{pointAttrs, "", ts, "", &f})
+		}
+		if len(points) == 0 {
+			return m, false
+		}
+		m.Gauge = &gauge{points}
+	}
+	return m, true
+}
+
+func attributes(labels map[string]string) []keyValue {
+	if len(labels) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]keyValue, len(keys))
+	for i, k := range keys {
+		attrs[i] = keyValue{k, anyValue{labels[k]}}
+	}
+	return attrs
+}
+
+func nanos(t int64) string {
+	return strconv.FormatInt(t, 10)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2014 Square, Inc
+
+package otlp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+func TestExport(t *testing.T) {
+	var got exportRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", r.Header.Get("Content-Type"))
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	m := metrics.NewMetricContext("webapp")
+	m.MustNewCounter("requests").Add(3)
+	m.MustNewGauge("queue").Set(1.5)
+	m.MustNewGauge("unset")
+	s := m.MustNewStatsTimer("latency", time.Millisecond, 10)
+	s.Observe(2 * time.Millisecond)
+	m.MustNewHistogram("size", time.Nanosecond, []float64{10}).Observe(20)
+	v := metrics.NewCounterVec("code")
+	m.Register(v, "http")
+	v.With("code", "200").Add(1)
+	v.With("code", "500").Add(1)
+
+	e := New(m, collector.URL+"/v1/metrics")
+	if err := e.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.ResourceMetrics) != 1 {
+		t.Fatalf("len(ResourceMetrics) = %v, want 1", len(got.ResourceMetrics))
+	}
+	rm := got.ResourceMetrics[0]
+	attr := rm.Resource.Attributes
+	if len(attr) != 1 || attr[0].Key != "service.name" || attr[0].Value.StringValue != "webapp" {
+		t.Errorf("resource attributes = %+v, want service.name=webapp", attr)
+	}
+
+	byName := make(map[string]metric)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		byName[m.Name] = m
+	}
+	if len(byName) != 5 {
+		t.Errorf("exported %v metrics, want 5", len(byName))
+	}
+	if s := byName["requests"].Sum; s == nil || s.DataPoints[0].AsInt != "3" ||
+		!s.IsMonotonic || s.AggregationTemporality != temporalityCumulative {
+		t.Errorf("requests = %+v, want cumulative monotonic sum of 3", s)
+	}
+	if g := byName["queue"].Gauge; g == nil || *g.DataPoints[0].AsDouble != 1.5 {
+		t.Errorf("queue = %+v, want gauge of 1.5", g)
+	}
+	if s := byName["latency"].Summary; s == nil || s.DataPoints[0].Count != "1" ||
+		s.DataPoints[0].Sum != 2 || s.DataPoints[0].QuantileValues[0].Quantile != 0.5 {
+		t.Errorf("latency = %+v, want summary", s)
+	}
+	if h := byName["size"].Histogram; h == nil || h.DataPoints[0].BucketCounts[1] != "1" {
+		t.Errorf("size = %+v, want histogram", h)
+	}
+	if s := byName["http"].Sum; s == nil || len(s.DataPoints) != 2 ||
+		s.DataPoints[0].Attributes[0].Key != "code" {
+		t.Errorf("http = %+v, want two data points with code attribute", s)
+	}
+}
+
+func TestExportLabeledHistograms(t *testing.T) {
+	m := metrics.NewMetricContext("webapp")
+	m.RegisterCollector(metrics.CollectorFunc(func(b *metrics.Batch) error {
+		for _, table := range []string{"orders", "users"} {
+			h := metrics.NewHistogram(time.Nanosecond, []float64{10})
+			h.Observe(20)
+			b.Add("row_size", map[string]string{"table": table}, h)
+		}
+		return nil
+	}), "db")
+
+	e := New(m, "")
+	r, err := e.request(1400000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rm := range r.ResourceMetrics {
+		for _, m := range rm.ScopeMetrics[0].Metrics {
+			if m.Name != "db.row_size" {
+				continue
+			}
+			if h := m.Histogram; h == nil || len(h.DataPoints) != 2 ||
+				h.DataPoints[1].Attributes[0].Value.StringValue != "users" {
+				t.Errorf("db.row_size = %+v, want two data points with table attribute", h)
+			}
+			return
+		}
+	}
+	t.Errorf("db.row_size not exported")
+}
+
+func TestExportKindConflict(t *testing.T) {
+	m := metrics.NewMetricContext("webapp")
+	m.RegisterCollector(metrics.CollectorFunc(func(b *metrics.Batch) error {
+		b.Gauge("size", 1, "table", "a")
+		b.Counter("size", 2, "table", "b")
+		return nil
+	}), "db")
+
+	e := New(m, "")
+	r, err := e.request(1400000000)
+	if err == nil || !strings.Contains(err.Error(), "db.size") {
+		t.Errorf("e.request() error = %v, want a conflict for db.size", err)
+	}
+	for _, m := range r.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if m.Name != "db.size" {
+			continue
+		}
+		if g := m.Gauge; g == nil || len(g.DataPoints) != 1 || m.Sum != nil {
+			t.Errorf("db.size = %+v, want the gauge data point only", m)
+		}
+	}
+}
+
+func TestExportCounterFunc(t *testing.T) {
+	m := metrics.NewMetricContext("webapp")
+	m.MustNewCounterFunc("queries", func() uint64 { return 42 })
+
+	r, err := New(m, "").request(1400000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(got) != 1 || got[0].Sum == nil || !got[0].Sum.IsMonotonic ||
+		got[0].Sum.DataPoints[0].AsInt != "42" {
+		t.Errorf("queries = %+v, want cumulative monotonic sum of 42", got)
+	}
+}
+
+func TestStop(t *testing.T) {
+	requests := 0
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer collector.Close()
+
+	m := metrics.NewMetricContext("webapp")
+	m.MustNewGauge("queue").Set(1)
+
+	// the final export is sent although the interval never elapsed
+	e := New(m, collector.URL+"/v1/metrics")
+	e.Start()
+	if err := e.Stop(); err != nil {
+		t.Errorf("e.Stop() = %v, want nil", err)
+	}
+	if requests != 1 {
+		t.Errorf("%v requests, want 1", requests)
+	}
+}
+
+func TestExportError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer collector.Close()
+
+	e := New(metrics.NewMetricContext("webapp"), collector.URL)
+	if err := e.Export(); err == nil {
+		t.Errorf("e.Export() = nil, want error for status 400")
+	}
+}
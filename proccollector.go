@@ -0,0 +1,219 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// default mount point of the proc filesystem
+const PROC_ROOT = "/proc"
+
+// clock ticks per second of the CPU times in /proc/<pid>/stat. Linux
+// reports them in USER_HZ, which is 100 on all common architectures
+const PROC_CLK_TCK = 100
+
+/* ProcCollector
+
+ProcCollector is a Collector exporting the resource usage of the current
+process from the Linux proc filesystem. Metrics, named below the name
+the collector is registered under:
+
+  cpu_user_seconds               - counter, from self/stat
+  cpu_system_seconds             - counter, from self/stat
+  threads                        - gauge, from self/stat
+  rss_bytes                      - gauge, VmRSS from self/status
+  vsz_bytes                      - gauge, VmSize from self/status
+  voluntary_context_switches     - counter, from self/status
+  involuntary_context_switches   - counter, from self/status
+  read_bytes                     - counter, storage reads from self/io
+  write_bytes                    - counter, storage writes from self/io
+  open_fds                       - gauge, entries of self/fd
+  max_fds                        - gauge, soft limit from self/limits
+
+A file that cannot be read or parsed, e.g. self/io without the needed
+permissions, is reported as the collect error; the metrics from the
+other files are still exported.
+
+Example use:
+  m := metrics.NewMetricContext("webapp")
+  m.RegisterCollector(metrics.NewProcCollector(metrics.PROC_ROOT), "process")
+
+*/
+
+type ProcCollector struct {
+	root string
+}
+
+// NewProcCollector initializes a ProcCollector reading the proc
+// filesystem mounted at root
+func NewProcCollector(root string) *ProcCollector {
+	return &ProcCollector{root}
+}
+
+// Collect adds the process metrics to b
+func (p *ProcCollector) Collect(b *Batch) error {
+	var errs []string
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	check(p.collectStat(b))
+	check(p.collectStatus(b))
+	check(p.collectIO(b))
+	check(p.collectFDs(b))
+	check(p.collectLimits(b))
+	if len(errs) > 0 {
+		return fmt.Errorf("metrics: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// unexported functions
+
+func (p *ProcCollector) path(name string) string {
+	return filepath.Join(p.root, "self", name)
+}
+
+// collectStat parses self/stat. The command name in the second field
+// may contain spaces and parentheses, so fields are counted from the
+// last ')'
+func (p *ProcCollector) collectStat(b *Batch) error {
+	data, err := ioutil.ReadFile(p.path("stat"))
+	if err != nil {
+		return err
+	}
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return fmt.Errorf("%s: malformed", p.path("stat"))
+	}
+	// fields[0] is field 3, the state
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 18 {
+		return fmt.Errorf("%s: %d fields, want at least 20", p.path("stat"), len(fields)+2)
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	threads, err3 := strconv.ParseUint(fields[17], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return fmt.Errorf("%s: malformed", p.path("stat"))
+	}
+	cpuCounter(b, "cpu_user_seconds", utime)
+	cpuCounter(b, "cpu_system_seconds", stime)
+	b.Gauge("threads", float64(threads))
+	return nil
+}
+
+func cpuCounter(b *Batch, name string, ticks uint64) {
+	c := NewFloatCounter()
+	c.Set(float64(ticks) / PROC_CLK_TCK)
+	b.Add(name, nil, c)
+}
+
+// collectStatus parses the "Key: value" lines of self/status
+func (p *ProcCollector) collectStatus(b *Batch) error {
+	values, err := p.readKeyValues("status", ":")
+	if err != nil {
+		return err
+	}
+	// memory sizes are in kB
+	if v, ok := values["VmRSS"]; ok {
+		b.Gauge("rss_bytes", float64(v*1024))
+	}
+	if v, ok := values["VmSize"]; ok {
+		b.Gauge("vsz_bytes", float64(v*1024))
+	}
+	if v, ok := values["voluntary_ctxt_switches"]; ok {
+		b.Counter("voluntary_context_switches", v)
+	}
+	if v, ok := values["nonvoluntary_ctxt_switches"]; ok {
+		b.Counter("involuntary_context_switches", v)
+	}
+	return nil
+}
+
+// collectIO parses the "key: value" lines of self/io
+func (p *ProcCollector) collectIO(b *Batch) error {
+	values, err := p.readKeyValues("io", ":")
+	if err != nil {
+		return err
+	}
+	if v, ok := values["read_bytes"]; ok {
+		b.Counter("read_bytes", v)
+	}
+	if v, ok := values["write_bytes"]; ok {
+		b.Counter("write_bytes", v)
+	}
+	return nil
+}
+
+func (p *ProcCollector) collectFDs(b *Batch) error {
+	fds, err := ioutil.ReadDir(p.path("fd"))
+	if err != nil {
+		return err
+	}
+	b.Gauge("open_fds", float64(len(fds)))
+	return nil
+}
+
+// collectLimits parses the soft limit of the "Max open files" line of
+// self/limits. An unlimited limit is left out
+func (p *ProcCollector) collectLimits(b *Batch) error {
+	data, err := ioutil.ReadFile(p.path("limits"))
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) == 0 {
+			break
+		}
+		if fields[0] == "unlimited" {
+			return nil
+		}
+		soft, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			break
+		}
+		b.Gauge("max_fds", float64(soft))
+		return nil
+	}
+	return fmt.Errorf("%s: no Max open files limit", p.path("limits"))
+}
+
+// readKeyValues returns the numeric values of the "key<sep> value ..."
+// lines of self/name, ignoring units and lines with other values
+func (p *ProcCollector) readKeyValues(name, sep string) (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(p.path(name))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]uint64)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), sep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			values[strings.TrimSpace(parts[0])] = v
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProcCollector(t *testing.T) {
+	p := NewProcCollector("testdata/proc")
+	b := &Batch{prefix: "process"}
+	if err := p.Collect(b); err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]float64)
+	for _, l := range b.metrics {
+		out[l.Name] = l.Metric.Values()["value"]
+	}
+
+	want := map[string]float64{
+		"process.cpu_user_seconds":             12.34,
+		"process.cpu_system_seconds":           5.67,
+		"process.threads":                      12,
+		"process.rss_bytes":                    10240 * 1024,
+		"process.vsz_bytes":                    1048576 * 1024,
+		"process.voluntary_context_switches":   150,
+		"process.involuntary_context_switches": 25,
+		"process.read_bytes":                   4096,
+		"process.write_bytes":                  8192,
+		"process.open_fds":                     4,
+		"process.max_fds":                      1024,
+	}
+	for name, w := range want {
+		if v, ok := out[name]; !ok || v != w {
+			t.Errorf("%s = %v, want %v", name, v, w)
+		}
+	}
+	if len(out) != len(want) {
+		t.Errorf("%v metrics, want %v", len(out), len(want))
+	}
+	if k := b.metrics[0].Metric.Kind(); k != "floatcounter" {
+		t.Errorf("cpu_user_seconds kind = %v, want floatcounter", k)
+	}
+}
+
+func TestProcCollectorMissingFiles(t *testing.T) {
+	m := NewMetricContext("")
+	m.RegisterCollector(NewProcCollector("testdata/noproc"), "process")
+	for _, l := range m.Collect() {
+		if l.Name != "process.collect_error" {
+			continue
+		}
+		ce := l.Metric.(*collectError)
+		if ce.err == nil || !strings.Contains(ce.err.Error(), "limits") {
+			t.Errorf("collect_error = %v, want an error naming limits", ce.err)
+		}
+		return
+	}
+	t.Errorf("process.collect_error missing")
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EncodePrometheus writes all metrics passing filter to writer w in the
+// Prometheus text exposition format (version 0.0.4). Metric names are
+// prefixed with the context namespace and sanitized to the Prometheus
+// naming rules. Children of metric vectors and the metrics of collectors
+// are written with their labels. Metrics of kinds the encoder does not
+// know are written as one untyped metric per value, see Metric.
+func (m *MetricContext) EncodePrometheus(w io.Writer) error {
+	for name, v := range m.Metrics() {
+		if err := m.writePrometheus(w, name, v); err != nil {
+			return err
+		}
+	}
+
+	// LabeledMetrics and Collect are sorted by name, so children of the
+	// same vector are adjacent and share a single header
+	prev := ""
+	for _, l := range append(m.LabeledMetrics(), m.Collect()...) {
+		if l.Labels == nil {
+			// collected without labels
+			if err := m.writePrometheus(w, l.Name, l.Metric); err != nil {
+				return err
+			}
+			continue
+		}
+		if !m.OutputFilter(l.Name, l.Metric) {
+			continue
+		}
+		pname := m.prometheusName(l.Name)
+		if l.Name != prev {
+			err := writePrometheusHeader(w, pname, m.fullName(l.Name), prometheusType(l.Metric))
+			if err != nil {
+				return err
+			}
+			prev = l.Name
+		}
+		if err := writePrometheusSamples(w, pname, l.Labels, l.Metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HttpPrometheusHandler setups a handler for exposing metrics in the
+// Prometheus text format over HTTP
+func (m *MetricContext) HttpPrometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.EncodePrometheus(w)
+}
+
+// unexported functions
+func (m *MetricContext) fullName(name string) string {
+	if m.namespace == "" {
+		return name
+	}
+	return m.namespace + "." + name
+}
+
+func (m *MetricContext) writePrometheus(w io.Writer, name string, v Metric) error {
+	if !m.OutputFilter(name, v) {
+		return nil
+	}
+	pname := m.prometheusName(name)
+	typ := prometheusType(v)
+	if typ == "untyped" {
+		return writePrometheusValues(w, pname, m.fullName(name), v)
+	}
+	if err := writePrometheusHeader(w, pname, m.fullName(name), typ); err != nil {
+		return err
+	}
+	return writePrometheusSamples(w, pname, nil, v)
+}
+
+// prometheusType returns the Prometheus type of v, or untyped if the
+// encoder does not know its kind
+func prometheusType(v Metric) string {
+	switch v.(type) {
+	case *Counter, *BasicCounter, *FloatCounter, *CounterFunc:
+		return "counter"
+	case *Gauge, *UpDownCounter, *GaugeFunc:
+		return "gauge"
+	case *StatsTimer:
+		return "summary"
+	case *Histogram:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// writePrometheusValues writes v as one untyped metric per value named
+// pname_key, or as pname if its only value is keyed value
+func writePrometheusValues(w io.Writer, pname, help string, v Metric) error {
+	values := v.Values()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := pname
+		if len(keys) > 1 || k != "value" {
+			name += "_" + sanitizePrometheusName(k)
+		}
+		if err := writePrometheusHeader(w, name, help, "untyped"); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s %s\n", name, formatPrometheusFloat(values[k]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePrometheusSamples(w io.Writer, pname string, labels map[string]string, v Metric) error {
+	var err error
+	switch v := v.(type) {
+	case *Counter:
+		_, err = fmt.Fprintf(w, "%s%s %d\n", pname, prometheusLabels(labels, "", ""), v.Get())
+	case *BasicCounter:
+		_, err = fmt.Fprintf(w, "%s%s %d\n", pname, prometheusLabels(labels, "", ""), v.Get())
+	case *UpDownCounter:
+		_, err = fmt.Fprintf(w, "%s%s %d\n", pname, prometheusLabels(labels, "", ""), v.Get())
+	case *FloatCounter:
+		_, err = fmt.Fprintf(w, "%s%s %s\n", pname, prometheusLabels(labels, "", ""),
+			formatPrometheusFloat(v.Get()))
+	case *Gauge:
+		_, err = fmt.Fprintf(w, "%s%s %s\n", pname, prometheusLabels(labels, "", ""),
+			formatPrometheusFloat(v.Get()))
+	case *GaugeFunc:
+		// a failed callback leaves the metric without a sample
+		if f, ferr := v.Get(); ferr == nil {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", pname, prometheusLabels(labels, "", ""),
+				formatPrometheusFloat(f))
+		}
+	case *CounterFunc:
+		if c, ferr := v.Get(); ferr == nil {
+			_, err = fmt.Fprintf(w, "%s%s %d\n", pname, prometheusLabels(labels, "", ""), c)
+		}
+	case *StatsTimer:
+		values, _ := v.percentiles(PERCENTILES)
+		for i, pctile := range values {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", pname,
+				prometheusLabels(labels, "quantile", formatPrometheusFloat(PERCENTILES[i]/100)),
+				formatPrometheusFloat(pctile))
+			if err != nil {
+				return err
+			}
+		}
+		total := v.CumulativeStats()
+		_, err = fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n",
+			pname, prometheusLabels(labels, "", ""), formatPrometheusFloat(total.Sum),
+			pname, prometheusLabels(labels, "", ""), total.Count)
+	case *Histogram:
+		bounds, counts := v.Buckets()
+		var cumulative uint64
+		for i, c := range counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(bounds) {
+				le = formatPrometheusFloat(bounds[i])
+			}
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", pname,
+				prometheusLabels(labels, "le", le), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n",
+			pname, prometheusLabels(labels, "", ""), formatPrometheusFloat(v.Sum()),
+			pname, prometheusLabels(labels, "", ""), cumulative)
+	default:
+		// labeled metric of an unknown kind, only its value key fits
+		// the family
+		if f, ok := v.Values()["value"]; ok {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", pname, prometheusLabels(labels, "", ""),
+				formatPrometheusFloat(f))
+		}
+	}
+	return err
+}
+
+// prometheusLabels renders labels, plus an optional extra label, as a
+// {name="value",...} suffix. It returns an empty string if there are
+// no labels at all
+func prometheusLabels(labels map[string]string, extraName, extraValue string) string {
+	if len(labels) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)+1)
+	for _, name := range sortedLabelNames(labels) {
+		pairs = append(pairs, sanitizePrometheusName(name)+`="`+
+			escapePrometheusLabel(labels[name])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapePrometheusLabel(extraValue)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapePrometheusLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func (m *MetricContext) prometheusName(name string) string {
+	if m.namespace == "" {
+		return sanitizePrometheusName(name)
+	}
+	return sanitizePrometheusName(m.namespace + "_" + name)
+}
+
+// sanitizePrometheusName maps name onto [a-zA-Z_:][a-zA-Z0-9_:]* by
+// replacing every invalid character with an underscore
+func sanitizePrometheusName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9':
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+func writePrometheusHeader(w io.Writer, pname, help, typ string) error {
+	help = strings.Replace(help, `\`, `\\`, -1)
+	help = strings.Replace(help, "\n", `\n`, -1)
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", pname, help, pname, typ)
+	return err
+}
+
+func formatPrometheusFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
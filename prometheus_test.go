@@ -0,0 +1,88 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodePrometheus(t *testing.T) {
+	m := NewMetricContext("web-app")
+	c := NewCounter()
+	m.Register(c, "http.requests")
+	c.Add(42)
+	g := NewGauge()
+	m.Register(g, "queue.depth")
+	g.Set(1.5)
+	b := NewBasicCounter()
+	m.Register(b, "9lives")
+	b.Add(9)
+	s := NewStatsTimer(time.Millisecond, 10)
+	m.Register(s, "latency")
+	for i := 0; i < 10; i++ {
+		s.ObserveValue(int64(i+1) * int64(time.Millisecond))
+	}
+
+	var buf bytes.Buffer
+	if err := m.EncodePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	want := []string{
+		"# HELP web_app_http_requests web-app.http.requests\n",
+		"# TYPE web_app_http_requests counter\n",
+		"web_app_http_requests 42\n",
+		"# TYPE web_app_queue_depth gauge\n",
+		"web_app_queue_depth 1.5\n",
+		"# TYPE web_app_9lives counter\n",
+		"web_app_9lives 9\n",
+		"# TYPE web_app_latency summary\n",
+		"web_app_latency{quantile=\"0.5\"} 6\n",
+		"web_app_latency{quantile=\"0.99\"} 10\n",
+		"web_app_latency_sum 55\n",
+		"web_app_latency_count 10\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("EncodePrometheus() missing %q in:\n%s", w, out)
+		}
+	}
+}
+
+func TestEncodePrometheusFilter(t *testing.T) {
+	m := NewMetricContext("test")
+	m.Register(NewGauge(), "visible")
+	m.Register(NewGauge(), "hidden")
+	m.OutputFilter = func(name string, v interface{}) bool {
+		return name != "hidden"
+	}
+
+	var buf bytes.Buffer
+	if err := m.EncodePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "test_hidden") {
+		t.Errorf("filtered metric in output:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "test_visible NaN\n") {
+		t.Errorf("expected test_visible in output:\n%s", buf.String())
+	}
+}
+
+func TestSanitizePrometheusName(t *testing.T) {
+	tests := map[string]string{
+		"foo.bar":     "foo_bar",
+		"a-b c":       "a_b_c",
+		"1st":         "_1st",
+		"ok:name_123": "ok:name_123",
+	}
+	for in, want := range tests {
+		if out := sanitizePrometheusName(in); out != want {
+			t.Errorf("sanitizePrometheusName(%q) = %q, want %q", in, out, want)
+		}
+	}
+}
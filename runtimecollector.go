@@ -0,0 +1,106 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// default minimum time between two runtime.ReadMemStats calls
+const RUNTIME_INTERVAL = 10 * time.Second
+
+// number of recent GC pauses the gc_pause distribution is computed on;
+// runtime.MemStats keeps the last 256
+const GC_PAUSES = 256
+
+/* RuntimeCollector
+
+RuntimeCollector is a Collector exporting the state of the Go runtime.
+runtime.ReadMemStats stops the world, so the memory statistics are
+refreshed at most once per interval, by the first scrape after it
+elapsed; other scrapes reuse the last read. Metrics, named below the
+name the collector is registered under:
+
+  goroutines              - gauge, runtime.NumGoroutine
+  threads                 - gauge, OS threads created
+  cgo_calls               - counter
+  heap_alloc_bytes        - gauge
+  heap_inuse_bytes        - gauge
+  heap_sys_bytes          - gauge
+  heap_objects            - gauge
+  gc_count                - counter, completed GC cycles
+  gc_pause_total_seconds  - counter
+  gc_pause                - StatsTimer of the last GC_PAUSES pauses, in ms
+
+Example use:
+  m := metrics.NewMetricContext("webapp")
+  m.RegisterCollector(metrics.NewRuntimeCollector(metrics.RUNTIME_INTERVAL), "runtime")
+
+*/
+
+type RuntimeCollector struct {
+	interval time.Duration
+	mu       sync.Mutex
+	last     time.Time // time of the last ReadMemStats
+	ms       runtime.MemStats
+	numGC    uint32 // GC cycles whose pause was added to pauses
+	pauses   *StatsTimer
+	read     func(*runtime.MemStats)
+	now      func() time.Time
+}
+
+// NewRuntimeCollector initializes a RuntimeCollector reading the memory
+// statistics at most once per interval
+func NewRuntimeCollector(interval time.Duration) *RuntimeCollector {
+	r := new(RuntimeCollector)
+	r.interval = interval
+	r.pauses = NewStatsTimer(time.Millisecond, GC_PAUSES)
+	r.read = runtime.ReadMemStats
+	r.now = time.Now
+	return r
+}
+
+// Collect adds the runtime metrics to b
+func (r *RuntimeCollector) Collect(b *Batch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := r.now(); r.last.IsZero() || now.Sub(r.last) >= r.interval {
+		r.read(&r.ms)
+		r.last = now
+		r.addPauses()
+	}
+
+	threads, _ := runtime.ThreadCreateProfile(nil)
+	b.Gauge("goroutines", float64(runtime.NumGoroutine()))
+	b.Gauge("threads", float64(threads))
+	b.Counter("cgo_calls", uint64(runtime.NumCgoCall()))
+	b.Gauge("heap_alloc_bytes", float64(r.ms.HeapAlloc))
+	b.Gauge("heap_inuse_bytes", float64(r.ms.HeapInuse))
+	b.Gauge("heap_sys_bytes", float64(r.ms.HeapSys))
+	b.Gauge("heap_objects", float64(r.ms.HeapObjects))
+	b.Counter("gc_count", uint64(r.ms.NumGC))
+	pauseTotal := NewFloatCounter()
+	pauseTotal.Set(float64(r.ms.PauseTotalNs) / NS_IN_SEC)
+	b.Add("gc_pause_total_seconds", nil, pauseTotal)
+	b.Add("gc_pause", nil, r.pauses)
+	return nil
+}
+
+// unexported functions
+
+// addPauses adds the pauses of the GC cycles completed since the last
+// read to the distribution. MemStats.PauseNs is a circular buffer
+// holding the most recent pause at (NumGC+255)%256
+func (r *RuntimeCollector) addPauses() {
+	n := r.ms.NumGC - r.numGC
+	if n > uint32(len(r.ms.PauseNs)) {
+		n = uint32(len(r.ms.PauseNs))
+	}
+	for i := r.ms.NumGC - n; i < r.ms.NumGC; i++ {
+		r.pauses.ObserveValue(int64(r.ms.PauseNs[i%uint32(len(r.ms.PauseNs))]))
+	}
+	r.numGC = r.ms.NumGC
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRuntimeCollector(t *testing.T) {
+	now := time.Unix(1000, 0)
+	reads := 0
+	var stats runtime.MemStats
+	r := NewRuntimeCollector(10 * time.Second)
+	r.now = func() time.Time { return now }
+	r.read = func(ms *runtime.MemStats) {
+		reads++
+		*ms = stats
+	}
+
+	collect := func() map[string]Metric {
+		b := &Batch{prefix: "runtime"}
+		if err := r.Collect(b); err != nil {
+			t.Fatal(err)
+		}
+		out := make(map[string]Metric)
+		for _, l := range b.metrics {
+			out[l.Name] = l.Metric
+		}
+		return out
+	}
+
+	// 300 GC cycles, more than PauseNs holds; the last 256 paused
+	// 1..256 ms
+	stats.NumGC = 300
+	stats.HeapAlloc = 1 << 20
+	for k := uint32(45); k <= 300; k++ {
+		stats.PauseNs[(k+255)%256] = uint64(k-44) * uint64(time.Millisecond)
+	}
+	out := collect()
+	if v := out["runtime.heap_alloc_bytes"].Values()["value"]; v != 1<<20 {
+		t.Errorf("heap_alloc_bytes = %v, want %v", v, 1<<20)
+	}
+	pauses := out["runtime.gc_pause"].(*StatsTimer)
+	if c := pauses.Count(); c != GC_PAUSES {
+		t.Errorf("gc_pause count = %v, want %v", c, GC_PAUSES)
+	}
+	if st := pauses.Stats(); st.Max != 256 || st.Min != 1 {
+		t.Errorf("gc_pause min, max = %v, %v, want 1, 256", st.Min, st.Max)
+	}
+
+	// within the interval the last read is reused
+	stats.NumGC = 302
+	stats.PauseNs[300%256] = uint64(500 * time.Millisecond)
+	stats.PauseNs[301%256] = uint64(600 * time.Millisecond)
+	now = now.Add(5 * time.Second)
+	collect()
+	if reads != 1 {
+		t.Errorf("ReadMemStats called %v times within the interval, want 1", reads)
+	}
+
+	now = now.Add(5 * time.Second)
+	out = collect()
+	if reads != 2 {
+		t.Errorf("ReadMemStats called %v times, want 2", reads)
+	}
+	if c := pauses.Count(); c != GC_PAUSES+2 {
+		t.Errorf("gc_pause count = %v, want %v", c, GC_PAUSES+2)
+	}
+	if st := pauses.Stats(); st.Max != 600 {
+		t.Errorf("gc_pause max = %v, want %v", st.Max, 600)
+	}
+	if v := out["runtime.gc_count"].Values()["value"]; v != 302 {
+		t.Errorf("gc_count = %v, want %v", v, 302)
+	}
+}
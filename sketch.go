@@ -0,0 +1,154 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+)
+
+// ddSketch is a mergeable quantile sketch with relative error
+// guarantees (DDSketch, http://arxiv.org/abs/1908.10693). Values are
+// counted into logarithmically sized bins so that every quantile is
+// reported within relativeAccuracy of its true value, using a bounded
+// number of bins. When the bin limit is reached the lowest bins are
+// collapsed, which only affects the accuracy of the smallest values.
+// Not safe for concurrent use.
+type ddSketch struct {
+	gamma    float64
+	logGamma float64
+	maxBins  int
+	offset   int // key of bins[0]
+	bins     []uint64
+	zero     uint64 // values too small to be indexed
+	count    uint64
+}
+
+// default bin limit; at 1% relative accuracy this covers values
+// spanning more than 17 orders of magnitude
+const SKETCH_MAX_BINS = 2048
+
+// newDDSketch panics if relativeAccuracy is not within (0, 1)
+func newDDSketch(relativeAccuracy float64, maxBins int) *ddSketch {
+	if !(relativeAccuracy > 0 && relativeAccuracy < 1) {
+		panic(fmt.Sprintf("metrics: relative accuracy %v not within (0, 1)", relativeAccuracy))
+	}
+	d := new(ddSketch)
+	d.gamma = (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	d.logGamma = math.Log(d.gamma)
+	d.maxBins = maxBins
+	return d
+}
+
+func (d *ddSketch) reset() {
+	d.bins = nil
+	d.offset = 0
+	d.zero = 0
+	d.count = 0
+}
+
+func (d *ddSketch) add(v float64) {
+	d.addCount(v, 1)
+}
+
+func (d *ddSketch) addCount(v float64, n uint64) {
+	d.count += n
+	if v < 1 {
+		d.zero += n
+		return
+	}
+	k := d.extend(int(math.Ceil(math.Log(v) / d.logGamma)))
+	d.bins[k-d.offset] += n
+}
+
+// extend makes sure key k is covered by bins, collapsing the lowest
+// bins if the limit would be exceeded. It returns the key k was mapped to
+func (d *ddSketch) extend(k int) int {
+	if len(d.bins) == 0 {
+		d.offset = k
+		d.bins = make([]uint64, 1)
+		return k
+	}
+	lo, hi := d.offset, d.offset+len(d.bins)-1
+	if k >= lo && k <= hi {
+		return k
+	}
+	if k > hi && k-lo < d.maxBins {
+		d.bins = append(d.bins, make([]uint64, k-hi)...)
+		return k
+	}
+
+	newLo, newHi := lo, hi
+	if k < lo {
+		newLo = k
+	}
+	if k > hi {
+		newHi = k
+	}
+	if newHi-newLo >= d.maxBins {
+		newLo = newHi - d.maxBins + 1
+	}
+	bins := make([]uint64, newHi-newLo+1)
+	for i, c := range d.bins {
+		key := d.offset + i
+		if key < newLo {
+			key = newLo
+		}
+		bins[key-newLo] += c
+	}
+	d.offset = newLo
+	d.bins = bins
+	if k < newLo {
+		return newLo
+	}
+	return k
+}
+
+// quantile returns an estimate of the q-th quantile (0 <= q <= 1) using
+// the same nearest rank definition as StatsTimer.Percentile
+func (d *ddSketch) quantile(q float64) (float64, bool) {
+	if d.count == 0 {
+		return math.NaN(), false
+	}
+	rank := uint64(q * float64(d.count))
+	if rank >= d.count {
+		rank = d.count - 1
+	}
+	if rank < d.zero {
+		return 0, true
+	}
+	cumulative := d.zero
+	for i, c := range d.bins {
+		cumulative += c
+		if cumulative > rank {
+			return d.value(d.offset + i), true
+		}
+	}
+	return d.value(d.offset + len(d.bins) - 1), true
+}
+
+// value returns the representative value of bin k
+func (d *ddSketch) value(k int) float64 {
+	return 2 * math.Pow(d.gamma, float64(k)) / (d.gamma + 1)
+}
+
+// merge adds all values counted by o, which must have been created
+// with the same relative accuracy
+func (d *ddSketch) merge(o *ddSketch) {
+	d.count += o.count
+	d.zero += o.zero
+	for i, c := range o.bins {
+		if c == 0 {
+			continue
+		}
+		k := d.extend(o.offset + i)
+		d.bins[k-d.offset] += c
+	}
+}
+
+func (d *ddSketch) copy() *ddSketch {
+	c := *d
+	c.bins = make([]uint64, len(d.bins))
+	copy(c.bins, d.bins)
+	return &c
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSketchStatsTimer(t *testing.T) {
+	s := NewSketchStatsTimer(time.Millisecond, 0.01)
+	for i := 1; i <= 10000; i++ {
+		s.ObserveValue(int64(i) * int64(time.Microsecond))
+	}
+
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		want := p / 100 * 10
+		pctile, err := s.Percentile(p)
+		if err != nil || math.Abs(pctile-want)/want > 0.011 {
+			t.Errorf("s.Percentile(%v) = %v, want %v within 1%%", p, pctile, want)
+		}
+	}
+}
+
+func TestSketchStatsTimerBadAccuracy(t *testing.T) {
+	for _, a := range []float64{0, -0.01, 1, 2, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewSketchStatsTimer(_, %v), want panic", a)
+				}
+			}()
+			NewSketchStatsTimer(time.Millisecond, a)
+		}()
+	}
+}
+
+func TestSketchStatsTimerMerge(t *testing.T) {
+	a := NewSketchStatsTimer(time.Millisecond, 0.01)
+	b := NewSketchStatsTimer(time.Millisecond, 0.01)
+	for i := 1; i <= 100; i++ {
+		a.ObserveValue(int64(i) * int64(time.Millisecond))
+		b.ObserveValue(int64(i+100) * int64(time.Millisecond))
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	pctile, _ := a.Percentile(50)
+	if math.Abs(pctile-101)/101 > 0.011 {
+		t.Errorf("a.Percentile(50) = %v, want %v", pctile, 101)
+	}
+
+	if err := a.Merge(NewStatsTimer(time.Millisecond, 10)); err == nil {
+		t.Errorf("a.Merge(ring timer), want error")
+	}
+}
+
+func TestSketchCollapse(t *testing.T) {
+	d := newDDSketch(0.01, 10)
+	for v := 1.0; v < 1e9; v *= 1.5 {
+		d.add(v)
+	}
+	if len(d.bins) > 10 {
+		t.Errorf("len(d.bins) = %v, want <= %v", len(d.bins), 10)
+	}
+	max, _ := d.quantile(1)
+	if math.Abs(max-1e9)/1e9 > 0.5 {
+		t.Errorf("d.quantile(1) = %v, want about %v", max, 1e9)
+	}
+}
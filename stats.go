@@ -0,0 +1,79 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"math"
+)
+
+// Stats holds summary statistics over a set of samples, expressed in
+// the time unit of the StatsTimer they were computed by. All fields are
+// zero if there are no samples
+type Stats struct {
+	Count  uint64
+	Sum    float64
+	Min    float64
+	Max    float64
+	Mean   float64
+	StdDev float64
+}
+
+// runningStats accumulates count, sum, min, max, mean and variance in
+// a single pass using Welford's algorithm
+type runningStats struct {
+	count uint64
+	sum   float64
+	min   float64
+	max   float64
+	mean  float64
+	m2    float64 // sum of squared deviations from mean
+}
+
+func (r *runningStats) add(v float64) {
+	if r.count == 0 || v < r.min {
+		r.min = v
+	}
+	if r.count == 0 || v > r.max {
+		r.max = v
+	}
+	r.count++
+	r.sum += v
+	delta := v - r.mean
+	r.mean += delta / float64(r.count)
+	r.m2 += delta * (v - r.mean)
+}
+
+// merge combines the statistics of o into r
+// http://en.wikipedia.org/wiki/Algorithms_for_calculating_variance#Parallel_algorithm
+func (r *runningStats) merge(o runningStats) {
+	if o.count == 0 {
+		return
+	}
+	if r.count == 0 {
+		*r = o
+		return
+	}
+	count := r.count + o.count
+	delta := o.mean - r.mean
+	r.m2 += o.m2 + delta*delta*float64(r.count)*float64(o.count)/float64(count)
+	r.mean += delta * float64(o.count) / float64(count)
+	r.sum += o.sum
+	r.min = math.Min(r.min, o.min)
+	r.max = math.Max(r.max, o.max)
+	r.count = count
+}
+
+// stats converts nanosecond statistics to timeUnit
+func (r *runningStats) stats(timeUnit float64) Stats {
+	if r.count == 0 {
+		return Stats{}
+	}
+	return Stats{
+		Count:  r.count,
+		Sum:    r.sum / timeUnit,
+		Min:    r.min / timeUnit,
+		Max:    r.max / timeUnit,
+		Mean:   r.mean / timeUnit,
+		StdDev: math.Sqrt(r.m2/float64(r.count)) / timeUnit,
+	}
+}
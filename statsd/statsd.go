@@ -0,0 +1,340 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package statsd periodically pushes the metrics of a MetricContext to
+// a statsd (or DogStatsD) aggregator over UDP.
+//
+// Counters, BasicCounters and CounterFuncs are sent as deltas since
+// the previous flush (|c). Start takes the values of the counters
+// present at that time as their baselines, so counters mirroring an
+// external value through Set do not send their whole total whenever
+// the exporter starts; counters appearing later send their full value
+// on the first flush. Gauges are sent as their current value (|g),
+// and every StatsTimer sample recorded since the previous flush as a
+// timing (|ms). Other metrics, except Histograms, are sent as one
+// gauge per value, see metrics.Metric. Metric names are prefixed with
+// the context namespace.
+//
+// Usage:
+//
+//	m := metrics.NewMetricContext("webapp")
+//	e, err := statsd.New(m, "localhost:8125")
+//	e.DogStatsD = true
+//	e.Tags = []string{"env:prod"}
+//	e.Start()
+//	defer e.Stop()
+package statsd
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+// default flush interval
+const FLUSH_INTERVAL = 10 * time.Second
+
+// default maximum packet size; fits a 1500 byte ethernet MTU after
+// IP and UDP headers
+const MAX_PACKET_SIZE = 1432
+
+type Exporter struct {
+	// FlushInterval is the time between two flushes
+	FlushInterval time.Duration
+	// MaxPacketSize is the maximum size of a datagram. Metrics are
+	// batched, newline separated, into datagrams up to this size
+	MaxPacketSize int
+	// DogStatsD enables DogStatsD tags. Labels of vector children are
+	// sent as tags instead of being appended to the metric name
+	DogStatsD bool
+	// Tags are added to every metric if DogStatsD is enabled
+	Tags []string
+
+	m        *metrics.MetricContext
+	conn     net.Conn
+	mu       sync.Mutex
+	counters map[string]uint64
+	timers   map[string]timerState
+	buf      []byte
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// timerState is the cumulative count and sum of a StatsTimer at the
+// previous flush
+type timerState struct {
+	count uint64
+	sum   float64
+}
+
+// New creates an Exporter sending the metrics of m to the statsd
+// server at addr
+func New(m *metrics.MetricContext, addr string) (*Exporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		FlushInterval: FLUSH_INTERVAL,
+		MaxPacketSize: MAX_PACKET_SIZE,
+		m:             m,
+		conn:          conn,
+		counters:      make(map[string]uint64),
+		timers:        make(map[string]timerState),
+	}
+	return e, nil
+}
+
+// Start takes the current values of all counters as baselines, then
+// flushes metrics every FlushInterval in a new goroutine until Stop is
+// called
+func (e *Exporter) Start() {
+	e.baseline()
+	e.quit = make(chan struct{})
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// statsd is fire and forget; a failed flush is retried
+				// with fresh deltas on the next tick
+				e.Flush()
+			case <-e.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the flush goroutine, flushes one last time and closes
+// the connection. It returns the error of the final flush, or of
+// closing the connection
+func (e *Exporter) Stop() error {
+	if e.quit != nil {
+		close(e.quit)
+		<-e.done
+	}
+	err := e.Flush()
+	if cerr := e.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Flush sends all metrics passing the context's OutputFilter. It
+// returns the first error encountered writing to the connection
+func (e *Exporter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.buf = e.buf[:0]
+	var err error
+	send := func(line string) {
+		if werr := e.add(line); err == nil {
+			err = werr
+		}
+	}
+
+	write := func(name string, labels map[string]string, v metrics.Metric) {
+		switch v := v.(type) {
+		case *metrics.Counter:
+			send(e.counter(name, labels, v.Get()))
+		case *metrics.BasicCounter:
+			send(e.counter(name, labels, v.Get()))
+		case *metrics.CounterFunc:
+			// a failed callback leaves the metric out
+			if c, err := v.Get(); err == nil {
+				send(e.counter(name, labels, c))
+			}
+		case *metrics.StatsTimer:
+			for _, line := range e.timings(name, labels, v) {
+				send(line)
+			}
+		case *metrics.Histogram:
+			// bucket counts have no statsd equivalent
+		default:
+			for k, value := range v.Values() {
+				n := name
+				if k != "value" {
+					n += "." + k
+				}
+				if line, ok := e.gauge(n, labels, value); ok {
+					send(line)
+				}
+			}
+		}
+	}
+
+	e.each(write)
+
+	if werr := e.send(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// unexported functions
+
+// each calls f for every metric passing the context's OutputFilter
+func (e *Exporter) each(f func(name string, labels map[string]string, v metrics.Metric)) {
+	for name, v := range e.m.Metrics() {
+		if e.m.OutputFilter(name, v) {
+			f(name, nil, v)
+		}
+	}
+	for _, l := range append(e.m.LabeledMetrics(), e.m.Collect()...) {
+		if e.m.OutputFilter(l.Name, l.Metric) {
+			f(l.Name, l.Labels, l.Metric)
+		}
+	}
+}
+
+// baseline records the current value of every counter as already sent
+func (e *Exporter) baseline() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.each(func(name string, labels map[string]string, v metrics.Metric) {
+		switch v := v.(type) {
+		case *metrics.Counter:
+			e.counters[e.name(name, labels)] = v.Get()
+		case *metrics.BasicCounter:
+			e.counters[e.name(name, labels)] = v.Get()
+		case *metrics.CounterFunc:
+			if c, err := v.Get(); err == nil {
+				e.counters[e.name(name, labels)] = c
+			}
+		}
+	})
+}
+
+// counter returns the line for the delta of a counter since the last
+// flush, or since its baseline. A counter going down is treated as
+// restarted from zero
+func (e *Exporter) counter(name string, labels map[string]string, v uint64) string {
+	key := e.name(name, labels)
+	delta := v
+	if prev, ok := e.counters[key]; ok && v >= prev {
+		delta = v - prev
+	}
+	e.counters[key] = v
+	return key + ":" + strconv.FormatUint(delta, 10) + "|c" + e.tags(labels)
+}
+
+func (e *Exporter) gauge(name string, labels map[string]string, v float64) (string, bool) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "", false
+	}
+	return e.name(name, labels) + ":" + formatFloat(v) + "|g" + e.tags(labels), true
+}
+
+// timings returns one line per sample recorded since the last flush.
+// Samples the timer did not retain are sent as a single line holding
+// their mean with a sample rate, so statsd still counts all of them
+func (e *Exporter) timings(name string, labels map[string]string, s *metrics.StatsTimer) []string {
+	key := e.name(name, labels)
+	prev := e.timers[key]
+	samples, total := s.SamplesSince(prev.count)
+	if prev.count > total.Count {
+		// timer was reset
+		prev = timerState{}
+	}
+	e.timers[key] = timerState{total.Count, total.Sum}
+
+	var lines []string
+	tags := e.tags(labels)
+	sum := 0.0
+	for _, v := range samples {
+		lines = append(lines, key+":"+formatFloat(v)+"|ms"+tags)
+		sum += v
+	}
+
+	missing := total.Count - prev.count - uint64(len(samples))
+	if missing > 0 {
+		mean := (total.Sum - prev.sum - sum) / float64(missing)
+		lines = append(lines, key+":"+formatFloat(mean)+"|ms|@"+
+			formatFloat(1/float64(missing))+tags)
+	}
+	return lines
+}
+
+func (e *Exporter) name(name string, labels map[string]string) string {
+	n := name
+	if !e.DogStatsD {
+		for _, k := range sortedKeys(labels) {
+			n += "." + labels[k]
+		}
+	}
+	if ns := e.m.Namespace(); ns != "" {
+		n = ns + "." + n
+	}
+	return sanitize(n)
+}
+
+func (e *Exporter) tags(labels map[string]string) string {
+	if !e.DogStatsD || (len(e.Tags) == 0 && len(labels) == 0) {
+		return ""
+	}
+	tags := make([]string, 0, len(e.Tags)+len(labels))
+	tags = append(tags, e.Tags...)
+	for _, k := range sortedKeys(labels) {
+		tags = append(tags, sanitize(k)+":"+sanitize(labels[k]))
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// add appends line to the current packet, sending the packet first if
+// line would not fit
+func (e *Exporter) add(line string) error {
+	var err error
+	if len(e.buf) > 0 && len(e.buf)+1+len(line) > e.MaxPacketSize {
+		err = e.send()
+	}
+	if len(e.buf) > 0 {
+		e.buf = append(e.buf, '\n')
+	}
+	e.buf = append(e.buf, line...)
+	return err
+}
+
+func (e *Exporter) send() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	_, err := e.conn.Write(e.buf)
+	e.buf = e.buf[:0]
+	return err
+}
+
+// sanitize replaces the characters that are part of the statsd line
+// format, and whitespace, with underscores
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func sortedKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
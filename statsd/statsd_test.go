@@ -0,0 +1,222 @@
+// Copyright (c) 2014 Square, Inc
+
+package statsd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+// listen starts a local UDP listener and returns it along with a
+// function reading all lines from the next datagram
+func listen(t *testing.T) (*net.UDPConn, func() []string) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() []string {
+		b := make([]byte, 65536)
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := l.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(b[:n]), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+	return l, read
+}
+
+func TestFlush(t *testing.T) {
+	l, read := listen(t)
+	defer l.Close()
+
+	m := metrics.NewMetricContext("app")
+	c := m.MustNewCounter("requests")
+	g := m.MustNewGauge("queue")
+	s := m.MustNewStatsTimer("latency", time.Millisecond, 10)
+	m.MustNewGauge("unset")
+
+	e, err := New(m, l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	c.Add(5)
+	g.Set(2.5)
+	s.Observe(3 * time.Millisecond)
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(read(), " ")
+	want := "app.latency:3|ms app.queue:2.5|g app.requests:5|c"
+	if got != want {
+		t.Errorf("first flush = %q, want %q", got, want)
+	}
+
+	c.Add(2)
+	s.Observe(4 * time.Millisecond)
+	s.Observe(5 * time.Millisecond)
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got = strings.Join(read(), " ")
+	want = "app.latency:4|ms app.latency:5|ms app.queue:2.5|g app.requests:2|c"
+	if got != want {
+		t.Errorf("second flush = %q, want %q", got, want)
+	}
+}
+
+func TestCounterBaseline(t *testing.T) {
+	l, read := listen(t)
+	defer l.Close()
+
+	// a counter mirroring an external total, e.g. a server status
+	// variable
+	m := metrics.NewMetricContext("app")
+	c := m.MustNewBasicCounter("queries")
+	c.Set(1000000)
+	v := metrics.NewCounterVec("code")
+	m.Register(v, "http")
+
+	e, err := New(m, l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.FlushInterval = time.Hour
+	e.Start()
+	defer e.Stop()
+
+	c.Set(1000003)
+	// appears after Start, all of its count is sent
+	v.With("code", "503").Add(1)
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(read(), " ")
+	if want := "app.http.503:1|c app.queries:3|c"; got != want {
+		t.Errorf("first flush = %q, want %q", got, want)
+	}
+
+	// restarted from zero
+	c.Set(4)
+	e.Flush()
+	got = strings.Join(read(), " ")
+	if want := "app.http.503:0|c app.queries:4|c"; got != want {
+		t.Errorf("flush after restart = %q, want %q", got, want)
+	}
+}
+
+func TestCounterFunc(t *testing.T) {
+	l, read := listen(t)
+	defer l.Close()
+
+	var n uint64 = 5
+	m := metrics.NewMetricContext("app")
+	m.MustNewCounterFunc("queries", func() uint64 { return n })
+
+	e, err := New(m, l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	for _, want := range []string{"app.queries:5|c", "app.queries:2|c"} {
+		e.Flush()
+		if got := strings.Join(read(), " "); got != want {
+			t.Errorf("flush = %q, want %q", got, want)
+		}
+		n += 2
+	}
+}
+
+func TestSketchTimerSampleRate(t *testing.T) {
+	l, read := listen(t)
+	defer l.Close()
+
+	m := metrics.NewMetricContext("")
+	s := metrics.NewSketchStatsTimer(time.Millisecond, 0.01)
+	m.Register(s, "latency")
+	for i := 1; i <= 4; i++ {
+		s.Observe(time.Duration(i) * time.Millisecond)
+	}
+
+	e, err := New(m, l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	e.Flush()
+	got := strings.Join(read(), " ")
+	if want := "latency:2.5|ms|@0.25"; got != want {
+		t.Errorf("flush = %q, want %q", got, want)
+	}
+}
+
+func TestDogStatsDTags(t *testing.T) {
+	l, read := listen(t)
+	defer l.Close()
+
+	m := metrics.NewMetricContext("app")
+	v := metrics.NewCounterVec("code")
+	m.Register(v, "http")
+	v.With("code", "200").Add(1)
+
+	e, err := New(m, l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	e.Flush()
+	got := strings.Join(read(), " ")
+	if want := "app.http.200:1|c"; got != want {
+		t.Errorf("flush = %q, want %q", got, want)
+	}
+
+	e, err = New(m, l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	e.DogStatsD = true
+	e.Tags = []string{"env:test"}
+
+	e.Flush()
+	got = strings.Join(read(), " ")
+	if want := "app.http:1|c|#env:test,code:200"; got != want {
+		t.Errorf("flush = %q, want %q", got, want)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	l, read := listen(t)
+	defer l.Close()
+
+	m := metrics.NewMetricContext("app")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		m.MustNewBasicCounter(name).Add(1)
+	}
+
+	e, err := New(m, l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	e.MaxPacketSize = 22 // two lines of 9 bytes plus a newline
+
+	e.Flush()
+	for i := 0; i < 2; i++ {
+		if lines := read(); len(lines) != 2 {
+			t.Errorf("packet %d holds %v, want 2 lines", i, lines)
+		}
+	}
+}
@@ -5,10 +5,10 @@ package metrics
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,9 +19,13 @@ Arguments:
   timeUnit time.Duration - time unit to report statistics on
   nsamples int - number of samples to keep in-memory for stats computation
 
+Use NewSketchStatsTimer instead to account for every sample with bounded
+memory, at the cost of approximate percentiles, or NewWindowedStatsTimer
+to only consider samples recorded within a sliding time window.
+
 Example use:
   m := metrics.NewMetricContext("webapp")
-  s := m.NewStatsTimer("latency", time.Millisecond, 100)
+  s := m.MustNewStatsTimer("latency", time.Millisecond, 100)
 
   func (wa *WebApp)  HandleQuery(w http.ResponseWriter, r *http.Request) {
 	  stopWatch := s.Start()
@@ -38,23 +42,74 @@ Example use:
 */
 
 type StatsTimer struct {
-	history  []int64
-	idx      int
+	store    sampleStore
+	total    runningStats // every sample since Reset
 	mu       sync.RWMutex
 	timeUnit time.Duration
 }
 
+// sampleStore holds the samples a StatsTimer computes statistics on.
+// Access is serialized by StatsTimer.mu
+type sampleStore interface {
+	add(v int64)
+	// percentiles returns the nanosecond value of each of ps, or false
+	// if no samples have been recorded
+	percentiles(ps []float64) ([]float64, bool)
+	// stats returns nanosecond statistics over the samples percentiles
+	// are computed on
+	stats() runningStats
+	// recent returns up to n of the most recently added samples that
+	// are still retained, oldest first
+	recent(n int) []int64
+	reset()
+}
+
 const NOT_INITIALIZED = -1
 
 // default percentiles to compute when serializing statstimer type
 // to stdout/json
 var PERCENTILES = []float64{50, 75, 95, 99, 99.9, 99.99, 99.999}
 
+// NewStatsTimer initializes a StatsTimer that keeps the last nsamples
+// samples in memory and computes exact percentiles over them
 func NewStatsTimer(timeUnit time.Duration, nsamples int) *StatsTimer {
 
 	s := new(StatsTimer)
 	s.timeUnit = timeUnit
-	s.history = make([]int64, nsamples)
+	s.store = &ringStore{history: make([]int64, nsamples)}
+
+	s.Reset()
+
+	return s
+}
+
+// number of sub-windows the window of a windowed StatsTimer is split into
+const WINDOW_SLOTS = 6
+
+// NewWindowedStatsTimer initializes a StatsTimer whose statistics only
+// consider samples recorded within the last window (e.g. time.Minute).
+// The window is split into WINDOW_SLOTS sub-windows which are rotated
+// out as they expire, so the effective window slides in steps of
+// window/WINDOW_SLOTS. At most nsamples samples are kept per window
+func NewWindowedStatsTimer(timeUnit time.Duration, window time.Duration, nsamples int) *StatsTimer {
+	s := new(StatsTimer)
+	s.timeUnit = timeUnit
+	s.store = newWindowStore(int64(window/WINDOW_SLOTS), WINDOW_SLOTS, nsamples)
+
+	s.Reset()
+
+	return s
+}
+
+// NewSketchStatsTimer initializes a StatsTimer backed by a quantile
+// sketch instead of a ring of samples. It accounts for every sample
+// ever recorded using bounded memory, and reports percentiles within
+// relativeAccuracy (e.g. 0.01 for 1%) of their exact value. It panics
+// if relativeAccuracy is not within (0, 1)
+func NewSketchStatsTimer(timeUnit time.Duration, relativeAccuracy float64) *StatsTimer {
+	s := new(StatsTimer)
+	s.timeUnit = timeUnit
+	s.store = &sketchStore{sketch: newDDSketch(relativeAccuracy, SKETCH_MAX_BINS)}
 
 	s.Reset()
 
@@ -62,9 +117,10 @@ func NewStatsTimer(timeUnit time.Duration, nsamples int) *StatsTimer {
 }
 
 func (s *StatsTimer) Reset() {
-	for i := range s.history {
-		s.history[i] = NOT_INITIALIZED
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store.reset()
+	s.total = runningStats{}
 }
 
 func (s *StatsTimer) Start() *Timer {
@@ -75,16 +131,67 @@ func (s *StatsTimer) Start() *Timer {
 
 func (s *StatsTimer) Stop(t *Timer) float64 {
 	delta := t.Stop()
+	s.ObserveValue(delta)
+	return float64(delta) / float64(s.timeUnit.Nanoseconds())
+}
+
+// Observe records a duration measured elsewhere, e.g. taken from a
+// query log or computed with time.Since
+func (s *StatsTimer) Observe(d time.Duration) {
+	s.ObserveValue(int64(d))
+}
 
-	// Store current value in history
+// ObserveValue records a raw sample. Like durations, samples are
+// reported divided by the timer's time unit, so a timer created with
+// time.Nanosecond reports values unchanged and can be used as a general
+// distribution recorder. Negative values are recorded as 0
+func (s *StatsTimer) ObserveValue(v int64) {
+	if v < 0 {
+		v = 0
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.history[s.idx] = delta
-	s.idx++
-	if s.idx == len(s.history) {
-		s.idx = 0
+	s.store.add(v)
+	s.total.add(float64(v))
+}
+
+// Time runs f and records how long it took. It returns the elapsed
+// time in the timer's time unit
+func (s *StatsTimer) Time(f func()) float64 {
+	start := time.Now()
+	f()
+	d := time.Since(start)
+	s.Observe(d)
+	return float64(d) / float64(s.timeUnit.Nanoseconds())
+}
+
+// Merge adds all samples recorded by o into s. Both timers must be
+// sketch backed and created with the same relative accuracy
+func (s *StatsTimer) Merge(o *StatsTimer) error {
+	o.mu.RLock()
+	other, ok := o.store.(*sketchStore)
+	var d *ddSketch
+	var ostats runningStats
+	if ok {
+		d = other.sketch.copy()
+		ostats = other.running
 	}
-	return float64(delta) / float64(s.timeUnit.Nanoseconds())
+	total := o.total
+	o.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, sok := s.store.(*sketchStore)
+	if !ok || !sok {
+		return errors.New("Merge requires sketch backed timers")
+	}
+	if ss.sketch.gamma != d.gamma {
+		return errors.New("Merge requires equal relative accuracy")
+	}
+	ss.sketch.merge(d)
+	ss.running.merge(ostats)
+	s.total.merge(total)
+	return nil
 }
 
 // TODO: move stats implementation to a dedicated package
@@ -96,59 +203,332 @@ func (a Int64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a Int64Slice) Less(i, j int) bool { return a[i] < a[j] }
 
 func (s *StatsTimer) Percentile(percentile float64) (float64, error) {
-	// Nearest rank implementation
-	// http://en.wikipedia.org/wiki/Percentile
-	histLen := len(s.history)
-
 	if percentile > 100 {
 		return math.NaN(), errors.New("Invalid argument")
 	}
 
-	in := make([]int64, 0, histLen)
-	for i := range s.history {
-		if s.history[i] != NOT_INITIALIZED {
-			in = append(in, s.history[i])
-		}
-	}
-
-	filtLen := len(in)
-
-	if filtLen < 1 {
+	v, ok := s.percentiles([]float64{percentile})
+	if !ok {
 		return math.NaN(), errors.New("No values")
 	}
+	return v[0], nil
+}
 
-	// Since slices are zero-indexed, we are naturally rounded up
-	nearest_rank := int((percentile / 100) * float64(filtLen))
+// Stats returns summary statistics over the samples percentiles are
+// computed on: the retained samples of a ring or the samples within the
+// window of a windowed timer. For sketch backed timers this is the same
+// as CumulativeStats
+func (s *StatsTimer) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r := s.store.stats()
+	return r.stats(float64(s.timeUnit.Nanoseconds()))
+}
 
-	if nearest_rank == filtLen {
-		nearest_rank = filtLen - 1
-	}
+// CumulativeStats returns summary statistics over every sample
+// recorded since the last Reset
+func (s *StatsTimer) CumulativeStats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.total.stats(float64(s.timeUnit.Nanoseconds()))
+}
 
-	sort.Sort(Int64Slice(in))
-	ret := float64(in[nearest_rank]) / float64(s.timeUnit.Nanoseconds())
+// Count returns the number of samples recorded since the last Reset
+func (s *StatsTimer) Count() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.total.count
+}
 
-	return ret, nil
+// SamplesSince returns the samples recorded after the first count
+// samples since Reset, in the timer's time unit and oldest first, along
+// with the cumulative statistics at that point. Pass the returned
+// Stats.Count as count on the next call to consume samples
+// incrementally. Samples that have been evicted since, or are not
+// retained at all by sketch backed timers, are only accounted for in
+// the returned Stats
+func (s *StatsTimer) SamplesSince(count uint64) ([]float64, Stats) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	unit := float64(s.timeUnit.Nanoseconds())
+	total := s.total.stats(unit)
+	if count > total.Count {
+		// timer was reset
+		count = 0
+	}
+	n := total.Count - count
+	if n == 0 {
+		return nil, total
+	}
+	raw := s.store.recent(int(n))
+	samples := make([]float64, len(raw))
+	for i, v := range raw {
+		samples[i] = float64(v) / unit
+	}
+	return samples, total
 }
 
 // MarshalJSON returns a byte slice containing representation of
 // StatsTimer
 func (s *StatsTimer) MarshalJSON() ([]byte, error) {
-	type percentileData struct {
-		percentile string
-		value      float64
-	}
-	var pctiles []percentileData
-	for _, p := range PERCENTILES {
-		percentile, err := s.Percentile(p)
-		stuff := fmt.Sprintf("%.6f", p)
-		if err == nil {
-			pctiles = append(pctiles, percentileData{stuff, percentile})
+	return s.marshalJSON(PERCENTILES)
+}
+
+// unexported functions
+
+// marshalJSON is MarshalJSON reporting percentiles ps
+func (s *StatsTimer) marshalJSON(ps []float64) ([]byte, error) {
+	var pctiles []percentileJSON
+
+	values, ok := s.percentiles(ps)
+	if ok {
+		for i, p := range ps {
+			pctiles = append(pctiles, percentileJSON{formatPercentile(p), values[i]})
 		}
 	}
 	data := struct {
-		Percentiles []percentileData
+		Percentiles []percentileJSON
+		Window      Stats
+		Cumulative  Stats
 	}{
 		pctiles,
+		s.Stats(),
+		s.CumulativeStats(),
 	}
 	return json.Marshal(data)
 }
+
+// percentiles computes all of ps in a single pass over the samples and
+// returns them in the timer's time unit
+func (s *StatsTimer) percentiles(ps []float64) ([]float64, bool) {
+	s.mu.RLock()
+	values, ok := s.store.percentiles(ps)
+	s.mu.RUnlock()
+
+	for i := range values {
+		values[i] /= float64(s.timeUnit.Nanoseconds())
+	}
+	return values, ok
+}
+
+// ringStore keeps the last len(history) samples
+type ringStore struct {
+	history []int64
+	idx     int
+}
+
+func (r *ringStore) add(v int64) {
+	r.history[r.idx] = v
+	r.idx++
+	if r.idx == len(r.history) {
+		r.idx = 0
+	}
+}
+
+func (r *ringStore) reset() {
+	for i := range r.history {
+		r.history[i] = NOT_INITIALIZED
+	}
+	r.idx = 0
+}
+
+func (r *ringStore) percentiles(ps []float64) ([]float64, bool) {
+	// Nearest rank implementation
+	// http://en.wikipedia.org/wiki/Percentile
+	in := r.appendSamples(make([]int64, 0, len(r.history)))
+	if len(in) < 1 {
+		return nil, false
+	}
+	sort.Sort(Int64Slice(in))
+	return nearestRanks(in, ps), true
+}
+
+func (r *ringStore) recent(n int) []int64 {
+	var in []int64
+	for i := range r.history {
+		v := r.history[(r.idx+i)%len(r.history)]
+		if v != NOT_INITIALIZED {
+			in = append(in, v)
+		}
+	}
+	if len(in) > n {
+		in = in[len(in)-n:]
+	}
+	return in
+}
+
+func (r *ringStore) stats() runningStats {
+	var rs runningStats
+	for _, v := range r.history {
+		if v != NOT_INITIALIZED {
+			rs.add(float64(v))
+		}
+	}
+	return rs
+}
+
+// appendSamples appends all recorded samples to in
+func (r *ringStore) appendSamples(in []int64) []int64 {
+	for _, v := range r.history {
+		if v != NOT_INITIALIZED {
+			in = append(in, v)
+		}
+	}
+	return in
+}
+
+// nearestRanks returns the values at each of percentiles ps in the
+// sorted slice in
+func nearestRanks(in []int64, ps []float64) []float64 {
+	filtLen := len(in)
+	r := make([]float64, len(ps))
+	for i, p := range ps {
+		// Since slices are zero-indexed, we are naturally rounded up
+		nearest_rank := int((p / 100) * float64(filtLen))
+
+		if nearest_rank >= filtLen {
+			nearest_rank = filtLen - 1
+		}
+		r[i] = float64(in[nearest_rank])
+	}
+	return r
+}
+
+// sketchStore accounts for all samples in a ddSketch
+type sketchStore struct {
+	sketch  *ddSketch
+	running runningStats
+}
+
+func (d *sketchStore) add(v int64) {
+	d.sketch.add(float64(v))
+	d.running.add(float64(v))
+}
+
+func (d *sketchStore) reset() {
+	d.sketch.reset()
+	d.running = runningStats{}
+}
+
+func (d *sketchStore) recent(n int) []int64 {
+	return nil
+}
+
+func (d *sketchStore) stats() runningStats {
+	return d.running
+}
+
+func (d *sketchStore) percentiles(ps []float64) ([]float64, bool) {
+	r := make([]float64, len(ps))
+	for i, p := range ps {
+		v, ok := d.sketch.quantile(p / 100)
+		if !ok {
+			return nil, false
+		}
+		r[i] = v
+	}
+	return r, true
+}
+
+// windowStore keeps samples in rotating sub-windows of slotLen
+// nanoseconds on the TICKS clock. A slot is reused, and its samples
+// dropped, once its sub-window has left the window
+type windowStore struct {
+	slotLen int64
+	slots   []windowSlot
+	now     func() int64
+}
+
+type windowSlot struct {
+	epoch int64 // TICKS / slotLen at the time the slot was started
+	ring  *ringStore
+}
+
+func newWindowStore(slotLen int64, nslots int, nsamples int) *windowStore {
+	w := new(windowStore)
+	if slotLen < 1 {
+		slotLen = 1
+	}
+	w.slotLen = slotLen
+	w.slots = make([]windowSlot, nslots)
+	perSlot := nsamples / nslots
+	if perSlot < 1 {
+		perSlot = 1
+	}
+	for i := range w.slots {
+		w.slots[i].ring = &ringStore{history: make([]int64, perSlot)}
+	}
+	w.now = func() int64 {
+		return atomic.LoadInt64(&TICKS)
+	}
+	return w
+}
+
+func (w *windowStore) add(v int64) {
+	epoch := w.now() / w.slotLen
+	slot := &w.slots[epoch%int64(len(w.slots))]
+	if slot.epoch != epoch {
+		slot.epoch = epoch
+		slot.ring.reset()
+	}
+	slot.ring.add(v)
+}
+
+func (w *windowStore) reset() {
+	for i := range w.slots {
+		w.slots[i].epoch = NOT_INITIALIZED
+		w.slots[i].ring.reset()
+	}
+}
+
+func (w *windowStore) percentiles(ps []float64) ([]float64, bool) {
+	var in []int64
+	for _, slot := range w.live() {
+		in = slot.ring.appendSamples(in)
+	}
+	if len(in) < 1 {
+		return nil, false
+	}
+	sort.Sort(Int64Slice(in))
+	return nearestRanks(in, ps), true
+}
+
+func (w *windowStore) recent(n int) []int64 {
+	live := w.live()
+	sort.Sort(slotsByEpoch(live))
+	var in []int64
+	for _, slot := range live {
+		in = append(in, slot.ring.recent(len(slot.ring.history))...)
+	}
+	if len(in) > n {
+		in = in[len(in)-n:]
+	}
+	return in
+}
+
+func (w *windowStore) stats() runningStats {
+	var rs runningStats
+	for _, slot := range w.live() {
+		rs.merge(slot.ring.stats())
+	}
+	return rs
+}
+
+// live returns the slots whose sub-window is still within the window
+func (w *windowStore) live() []windowSlot {
+	epoch := w.now() / w.slotLen
+	r := make([]windowSlot, 0, len(w.slots))
+	for _, slot := range w.slots {
+		if slot.epoch != NOT_INITIALIZED && epoch-slot.epoch < int64(len(w.slots)) {
+			r = append(r, slot)
+		}
+	}
+	return r
+}
+
+type slotsByEpoch []windowSlot
+
+func (a slotsByEpoch) Len() int           { return len(a) }
+func (a slotsByEpoch) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a slotsByEpoch) Less(i, j int) bool { return a[i].epoch < a[j].epoch }
@@ -0,0 +1,59 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// UpDownCounter is a signed counter(int64) that can go down as well as
+// up, e.g. for requests in flight - all operations are atomic
+// Usage:
+//   u := metrics.NewUpDownCounter()
+//   u.Inc()
+//   defer u.Dec()
+
+func NewUpDownCounter() *UpDownCounter {
+	c := new(UpDownCounter)
+	c.Reset()
+	return c
+}
+
+type UpDownCounter int64
+
+// Reset counter to zero
+func (c *UpDownCounter) Reset() {
+	atomic.StoreInt64((*int64)(c), 0)
+}
+
+// Set counter to value v
+func (c *UpDownCounter) Set(v int64) {
+	atomic.StoreInt64((*int64)(c), v)
+}
+
+// Add delta, which may be negative, to counter value
+func (c *UpDownCounter) Add(delta int64) {
+	atomic.AddInt64((*int64)(c), delta)
+}
+
+// Inc increments counter by one
+func (c *UpDownCounter) Inc() {
+	atomic.AddInt64((*int64)(c), 1)
+}
+
+// Dec decrements counter by one
+func (c *UpDownCounter) Dec() {
+	atomic.AddInt64((*int64)(c), -1)
+}
+
+// Get value of counter
+func (c *UpDownCounter) Get() int64 {
+	return atomic.LoadInt64((*int64)(c))
+}
+
+// MarshalJSON returns a byte slice of JSON representation of
+// updowncounter
+func (c *UpDownCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Get())
+}
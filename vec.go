@@ -0,0 +1,235 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Metric vectors
+
+A vector is a family of metrics sharing a name and a fixed label schema.
+Children are created lazily the first time a label combination is seen
+and are exported with their labels as structured fields.
+
+Example use:
+  m := metrics.NewMetricContext("webapp")
+  requests := metrics.NewCounterVec("endpoint", "code")
+  m.Register(requests, "http.requests")
+
+  requests.With("endpoint", "/foo", "code", "200").Add(1)
+
+*/
+
+// LabeledMetric is a single child of a registered metric vector
+type LabeledMetric struct {
+	Name   string
+	Labels map[string]string
+	Metric Metric
+}
+
+// vector is implemented by all metric vector types
+type vector interface {
+	children() []vecChild
+}
+
+type vecChild struct {
+	labels map[string]string
+	metric Metric
+}
+
+type metricVec struct {
+	labelNames []string
+	newMetric  func() Metric
+	mu         sync.RWMutex
+	entries    map[string]vecChild
+}
+
+func newMetricVec(labelNames []string, newMetric func() Metric) *metricVec {
+	v := new(metricVec)
+	v.labelNames = labelNames
+	v.newMetric = newMetric
+	v.entries = make(map[string]vecChild)
+	return v
+}
+
+// with returns the child for labelsAndValues, creating it if necessary.
+// labelsAndValues must name every label in the schema exactly once
+func (v *metricVec) with(labelsAndValues []string) Metric {
+	key, labels := v.key(labelsAndValues)
+
+	v.mu.RLock()
+	e, ok := v.entries[key]
+	v.mu.RUnlock()
+	if ok {
+		return e.metric
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if e, ok := v.entries[key]; ok {
+		return e.metric
+	}
+	e = vecChild{labels, v.newMetric()}
+	v.entries[key] = e
+	return e.metric
+}
+
+// Delete removes the child for labelsAndValues. It returns false if
+// no such child exists
+func (v *metricVec) Delete(labelsAndValues ...string) bool {
+	key, _ := v.key(labelsAndValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, ok := v.entries[key]
+	delete(v.entries, key)
+	return ok
+}
+
+// Reset removes all children
+func (v *metricVec) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.entries = make(map[string]vecChild)
+}
+
+func (v *metricVec) children() []vecChild {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	r := make([]vecChild, 0, len(v.entries))
+	for _, e := range v.entries {
+		r = append(r, e)
+	}
+	return r
+}
+
+func (v *metricVec) key(labelsAndValues []string) (string, map[string]string) {
+	if len(labelsAndValues) != 2*len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: expected labels %v, got %v",
+			v.labelNames, labelsAndValues))
+	}
+	labels := make(map[string]string, len(v.labelNames))
+	for i := 0; i < len(labelsAndValues); i += 2 {
+		labels[labelsAndValues[i]] = labelsAndValues[i+1]
+	}
+	values := make([]string, len(v.labelNames))
+	for i, name := range v.labelNames {
+		value, ok := labels[name]
+		if !ok {
+			panic(fmt.Sprintf("metrics: expected labels %v, got %v",
+				v.labelNames, labelsAndValues))
+		}
+		values[i] = value
+	}
+	return strings.Join(values, "\xff"), labels
+}
+
+// CounterVec is a vector of Counters
+type CounterVec struct {
+	*metricVec
+}
+
+// NewCounterVec initializes a CounterVec with the given label schema
+func NewCounterVec(labelNames ...string) *CounterVec {
+	return &CounterVec{newMetricVec(labelNames, func() Metric {
+		return NewCounter()
+	})}
+}
+
+// With returns the Counter for the given label name/value pairs, e.g.
+// With("endpoint", "/foo", "code", "200"). It panics if the labels do
+// not match the schema of the vector
+func (v *CounterVec) With(labelsAndValues ...string) *Counter {
+	return v.with(labelsAndValues).(*Counter)
+}
+
+// GaugeVec is a vector of Gauges
+type GaugeVec struct {
+	*metricVec
+}
+
+// NewGaugeVec initializes a GaugeVec with the given label schema
+func NewGaugeVec(labelNames ...string) *GaugeVec {
+	return &GaugeVec{newMetricVec(labelNames, func() Metric {
+		return NewGauge()
+	})}
+}
+
+// With returns the Gauge for the given label name/value pairs
+func (v *GaugeVec) With(labelsAndValues ...string) *Gauge {
+	return v.with(labelsAndValues).(*Gauge)
+}
+
+// StatsTimerVec is a vector of StatsTimers
+type StatsTimerVec struct {
+	*metricVec
+}
+
+// NewStatsTimerVec initializes a StatsTimerVec whose children are
+// created with NewStatsTimer(timeUnit, nsamples)
+func NewStatsTimerVec(timeUnit time.Duration, nsamples int, labelNames ...string) *StatsTimerVec {
+	return &StatsTimerVec{newMetricVec(labelNames, func() Metric {
+		return NewStatsTimer(timeUnit, nsamples)
+	})}
+}
+
+// With returns the StatsTimer for the given label name/value pairs
+func (v *StatsTimerVec) With(labelsAndValues ...string) *StatsTimer {
+	return v.with(labelsAndValues).(*StatsTimer)
+}
+
+// LabeledMetrics returns a snapshot of the children of all registered
+// vectors, sorted by name and then by label values
+func (m *MetricContext) LabeledMetrics() []LabeledMetric {
+	m.mu.RLock()
+	vecs := make(map[string]vector, len(m.vecs))
+	for name, v := range m.vecs {
+		vecs[name] = v
+	}
+	m.mu.RUnlock()
+
+	var r []LabeledMetric
+	for name, v := range vecs {
+		for _, c := range v.children() {
+			r = append(r, LabeledMetric{name, c.labels, c.metric})
+		}
+	}
+	sort.Sort(labeledMetrics(r))
+	return r
+}
+
+type labeledMetrics []LabeledMetric
+
+func (a labeledMetrics) Len() int      { return len(a) }
+func (a labeledMetrics) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a labeledMetrics) Less(i, j int) bool {
+	if a[i].Name != a[j].Name {
+		return a[i].Name < a[j].Name
+	}
+	return labelString(a[i].Labels) < labelString(a[j].Labels)
+}
+
+// labelString renders labels as a sorted, comma separated list of
+// name=value pairs
+func labelString(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, name := range sortedLabelNames(labels) {
+		pairs = append(pairs, name+"="+labels[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2014 Square, Inc
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterVecWith(t *testing.T) {
+	v := NewCounterVec("endpoint", "code")
+	v.With("endpoint", "/foo", "code", "200").Add(1)
+	v.With("code", "200", "endpoint", "/foo").Add(1)
+	v.With("endpoint", "/foo", "code", "500").Add(1)
+
+	if c := v.With("endpoint", "/foo", "code", "200").Get(); c != 2 {
+		t.Errorf("v.With().Get() = %v, want %v", c, 2)
+	}
+	if len(v.children()) != 2 {
+		t.Errorf("len(v.children()) = %v, want %v", len(v.children()), 2)
+	}
+	if !v.Delete("endpoint", "/foo", "code", "500") {
+		t.Errorf("v.Delete() = false, want true")
+	}
+}
+
+func TestVecWithBadLabels(t *testing.T) {
+	v := NewGaugeVec("endpoint")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("v.With() with unknown label, want panic")
+		}
+	}()
+	v.With("code", "200")
+}
+
+func TestVecJSON(t *testing.T) {
+	m := NewMetricContext("test")
+	v := NewGaugeVec("endpoint")
+	m.Register(v, "inflight")
+	v.With("endpoint", "/foo").Set(3)
+	m.Register(NewStatsTimerVec(time.Millisecond, 10, "endpoint"), "latency")
+
+	var buf bytes.Buffer
+	m.EncodeJSON(&buf)
+	var out []MetricJSON
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("len(out) = %v, want %v", len(out), 1)
+	}
+	if out[0].Name != "inflight" || out[0].Labels["endpoint"] != "/foo" ||
+		out[0].Value != float64(3) {
+		t.Errorf("unexpected vector child %+v", out[0])
+	}
+}
+
+func TestVecPrometheus(t *testing.T) {
+	m := NewMetricContext("test")
+	v := NewCounterVec("endpoint", "code")
+	m.Register(v, "http.requests")
+	v.With("endpoint", "/foo", "code", "200").Add(2)
+	v.With("endpoint", `/"bar"`, "code", "500").Add(1)
+
+	var buf bytes.Buffer
+	if err := m.EncodePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Count(out, "# TYPE test_http_requests counter\n") != 1 {
+		t.Errorf("expected a single TYPE line in:\n%s", out)
+	}
+	for _, w := range []string{
+		`test_http_requests{code="200",endpoint="/foo"} 2` + "\n",
+		`test_http_requests{code="500",endpoint="/\"bar\""} 1` + "\n",
+	} {
+		if !strings.Contains(out, w) {
+			t.Errorf("EncodePrometheus() missing %q in:\n%s", w, out)
+		}
+	}
+}